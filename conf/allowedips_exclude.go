@@ -6,70 +6,2079 @@
 package conf
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"math/big"
+	"net"
 	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func (config *Config) ApplyWstunnelHostExclusions() error {
-	if strings.TrimSpace(config.Interface.WstunnelHost) == "" {
+// Logger receives the messages emitted while applying WSTUNNEL_HOST
+// exclusions. It defaults to log.Printf.
+var Logger = log.Printf
+
+// DebugLogger, if set, receives a line for every WSTUNNEL_HOST entry saying
+// how it was interpreted and what it resolved to, and a multi-line report of
+// the AllowedIPs each peer ended up with.
+var DebugLogger func(format string, args ...any)
+
+// OnExclusionApplied, if set, is called with the index into Config.Peers of
+// every peer whose AllowedIPs were changed by WSTUNNEL_HOST exclusions.
+var OnExclusionApplied func(peerIndex int, before, after []netip.Prefix)
+
+// VerifyResolvedHost, if set, is called with every address a WSTUNNEL_HOST
+// hostname resolves to, before that address is added to the exclude set. An
+// error rejects the whole entry, for example when a PTR lookup of addr does
+// not lead back to an expected domain. It may be called concurrently for
+// different hostnames.
+var VerifyResolvedHost func(host string, addr netip.Addr) error
+
+// RejectLocalWstunnelHost turns the warning about WSTUNNEL_HOST entries that
+// refer to loopback, link-local or unspecified addresses into an error.
+var RejectLocalWstunnelHost bool
+
+// CompactWstunnelHostExcludes replaces the addresses a WSTUNNEL_HOST hostname
+// resolves to with the smallest prefix covering them, as long as that is no
+// shorter than a /24 or, for IPv6, a /64. This may exclude addresses the
+// hostname does not resolve to, which is why it is off by default.
+var CompactWstunnelHostExcludes bool
+
+// WstunnelExcludeDefaultRouteOnly limits WSTUNNEL_HOST exclusions to peers
+// whose AllowedIPs include 0.0.0.0/0 or ::/0, leaving peers that only route
+// specific subnets unfragmented. The extra excludes of ApplyExclusions and
+// the DNS servers still apply to every peer.
+var WstunnelExcludeDefaultRouteOnly bool
+
+// WarnOverlappingAllowedIPs logs a warning for each prefix routed by more than
+// one peer once exclusions change AllowedIPs. It is off by default, as
+// FindOverlappingAllowedIPs compares every pair of peers.
+var WarnOverlappingAllowedIPs bool
+
+// FragmentWarningThreshold is how many prefixes a single AllowedIPs entry may
+// be split into by WSTUNNEL_HOST exclusions before a warning is logged, as
+// drivers may limit how many AllowedIPs a peer has. Zero disables the warning.
+var FragmentWarningThreshold = 32
+
+// EmptiedAllowedIPsPolicy decides what happens when WSTUNNEL_HOST excludes
+// would leave a peer that had AllowedIPs without any.
+type EmptiedAllowedIPsPolicy int
+
+const (
+	// AllowEmptiedAllowedIPs empties the AllowedIPs of that peer, so that
+	// it routes nothing, and logs a warning.
+	AllowEmptiedAllowedIPs EmptiedAllowedIPsPolicy = iota
+	// SkipEmptiedAllowedIPs leaves the AllowedIPs of that peer unchanged
+	// and logs a warning.
+	SkipEmptiedAllowedIPs
+	// RejectEmptiedAllowedIPs fails to apply the exclusions at all.
+	RejectEmptiedAllowedIPs
+)
+
+// EmptiedAllowedIPs is the EmptiedAllowedIPsPolicy of ApplyWstunnelHostExclusions.
+// It defaults to AllowEmptiedAllowedIPs, so that a peer whose AllowedIPs are
+// all excluded only warns rather than stopping the tunnel from starting.
+var EmptiedAllowedIPs = AllowEmptiedAllowedIPs
+
+// UnresolvableWstunnelHostPolicy decides what happens when a WSTUNNEL_HOST
+// entry cannot be resolved, for instance during a DNS outage.
+type UnresolvableWstunnelHostPolicy int
+
+const (
+	// FailUnresolvableWstunnelHost applies the excludes that resolved but
+	// returns an error for the others.
+	FailUnresolvableWstunnelHost UnresolvableWstunnelHostPolicy = iota
+	// SkipUnresolvableWstunnelHost logs the entries that did not resolve
+	// and applies only the others.
+	SkipUnresolvableWstunnelHost
+	// SkipAllUnresolvableWstunnelHost logs the entries that did not resolve
+	// and leaves AllowedIPs without any exclusions.
+	SkipAllUnresolvableWstunnelHost
+)
+
+// WstunnelUnresolvablePolicy is the UnresolvableWstunnelHostPolicy of
+// ApplyWstunnelHostExclusions.
+var WstunnelUnresolvablePolicy = FailUnresolvableWstunnelHost
+
+var errWstunnelHostAbandoned = errors.New("WSTUNNEL_HOST exclusions abandoned")
+
+// AddressFamilies is a set of address families.
+type AddressFamilies uint8
+
+const (
+	FamilyIPv4 AddressFamilies = 1 << iota
+	FamilyIPv6
+)
+
+func (families AddressFamilies) contains(addr netip.Addr) bool {
+	if addr.Unmap().Is4() {
+		return families&FamilyIPv4 != 0
+	}
+	return families&FamilyIPv6 != 0
+}
+
+// WstunnelExcludeFamilies are the address families whose AllowedIPs
+// WSTUNNEL_HOST may change. Excludes of other families are ignored, so that,
+// for instance, leaving out FamilyIPv6 keeps every IPv6 AllowedIPs entry as
+// it is. By default both families are processed.
+var WstunnelExcludeFamilies = FamilyIPv4 | FamilyIPv6
+
+// MaxAllowedIPsAfterExclusion, if not zero, is how many AllowedIPs a peer
+// may have after WSTUNNEL_HOST exclusions before applying them fails.
+var MaxAllowedIPsAfterExclusion int
+
+// VerifyPrefixSubtraction makes every subtraction of excludes from AllowedIPs
+// check its own result, failing on any mistake. This is slow and meant for
+// debugging.
+var VerifyPrefixSubtraction bool
+
+// VerifyExclusionSubset makes applying exclusions check that the AllowedIPs
+// of each peer afterwards are within those before, failing on any address
+// they gained. Like VerifyPrefixSubtraction, it is meant for debugging.
+var VerifyExclusionSubset bool
+
+// WstunnelHostResolveConcurrency is how many WSTUNNEL_HOST hostnames are
+// resolved at once. One or less resolves them one after another.
+var WstunnelHostResolveConcurrency = 4
+
+// WstunnelHostResolveTimeout bounds each attempt at resolving a WSTUNNEL_HOST
+// hostname, so that a stuck lookup fails fast. Attempts that time out are
+// retried like temporary DNS errors, which at boot may take a while. Zero or
+// less disables it.
+var WstunnelHostResolveTimeout = 5 * time.Second
+
+// resolveGateway returns the addresses of the system's default gateways for
+// the @gateway WSTUNNEL_HOST entry.
+var resolveGateway = func() ([]netip.Addr, error) {
+	return nil, errors.New("looking up the default gateway is not supported on this platform")
+}
+
+// resolveOnLinkPrefix returns the on-link prefix containing addr for the
+// auto-subnet:HOST WSTUNNEL_HOST entry.
+var resolveOnLinkPrefix = func(addr netip.Addr) (netip.Prefix, error) {
+	return netip.Prefix{}, errors.New("looking up on-link prefixes is not supported on this platform")
+}
+
+// readHostsFile returns the contents of the hosts file that hosts:ALIAS
+// WSTUNNEL_HOST entries are looked up in.
+var readHostsFile = func() ([]byte, error) {
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	return os.ReadFile(filepath.Join(root, "System32", "drivers", "etc", "hosts"))
+}
+
+// resolveNamedPrefixSet returns the prefixes of the asn:NAME WSTUNNEL_HOST
+// entry, if set.
+var resolveNamedPrefixSet func(name string) ([]netip.Prefix, error)
+
+// SetNamedPrefixSetResolver sets how asn:NAME WSTUNNEL_HOST entries, such as
+// the address space of a cloud provider, are turned into prefixes.
+func SetNamedPrefixSetResolver(resolver func(name string) ([]netip.Prefix, error)) {
+	resolveNamedPrefixSet = resolver
+}
+
+// SetOnLinkPrefixResolver sets how auto-subnet:HOST WSTUNNEL_HOST entries
+// look up the on-link prefix of each address of HOST.
+func SetOnLinkPrefixResolver(resolver func(addr netip.Addr) (netip.Prefix, error)) {
+	resolveOnLinkPrefix = resolver
+}
+
+// SetHostsFileReader sets how hosts:ALIAS WSTUNNEL_HOST entries read the
+// hosts file, which by default is the one of the Windows installation.
+func SetHostsFileReader(reader func() ([]byte, error)) {
+	readHostsFile = reader
+}
+
+// SetGatewayResolver sets how @gateway WSTUNNEL_HOST entries look up the
+// addresses of the system's default gateways.
+func SetGatewayResolver(resolver func() ([]netip.Addr, error)) {
+	resolveGateway = resolver
+}
+
+var (
+	ErrWstunnelHostUnresolvable = errors.New("WSTUNNEL_HOST entry could not be resolved")
+	ErrWstunnelHostInvalid      = errors.New("WSTUNNEL_HOST entry is invalid")
+)
+
+// WstunnelHostError reports a WSTUNNEL_HOST entry that could not be excluded.
+// It matches ErrWstunnelHostUnresolvable when resolving Host failed, which
+// may succeed on a later attempt, and ErrWstunnelHostInvalid otherwise.
+type WstunnelHostError struct {
+	Entry string
+	Host  string
+	Err   error
+}
+
+func (e *WstunnelHostError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *WstunnelHostError) Unwrap() []error {
+	if len(e.Host) > 0 {
+		return []error{ErrWstunnelHostUnresolvable, e.Err}
+	}
+	return []error{ErrWstunnelHostInvalid, e.Err}
+}
+
+// classifyWstunnelHostError marks err as a syntax error in entry, unless it
+// already carries a WstunnelHostError.
+func classifyWstunnelHostError(entry string, err error) error {
+	var hostErr *WstunnelHostError
+	if errors.As(err, &hostErr) {
+		return err
+	}
+	return &WstunnelHostError{Entry: entry, Err: err}
+}
+
+// WstunnelHostStats counts WSTUNNEL_HOST activity since the process started.
+type WstunnelHostStats struct {
+	ResolutionSuccesses uint64
+	ResolutionFailures  uint64
+	ExcludesApplied     uint64
+}
+
+var wstunnelStats struct {
+	resolutionSuccesses atomic.Uint64
+	resolutionFailures  atomic.Uint64
+	excludesApplied     atomic.Uint64
+}
+
+// WstunnelStats returns how many WSTUNNEL_HOST hostnames resolved and failed
+// to resolve, and how many excludes were applied to configurations.
+func WstunnelStats() WstunnelHostStats {
+	return WstunnelHostStats{
+		ResolutionSuccesses: wstunnelStats.resolutionSuccesses.Load(),
+		ResolutionFailures:  wstunnelStats.resolutionFailures.Load(),
+		ExcludesApplied:     wstunnelStats.excludesApplied.Load(),
+	}
+}
+
+type PeerAllowedIPsDiff struct {
+	Peer   int
+	Before []netip.Prefix
+	After  []netip.Prefix
+}
+
+// PeerExclusionReport is the JSON form of a PeerAllowedIPsDiff, with Peer
+// indexing into Config.Peers.
+type PeerExclusionReport struct {
+	Peer       int            `json:"peer"`
+	PublicKey  string         `json:"public_key,omitempty"`
+	Removed    []netip.Prefix `json:"removed"`
+	AllowedIPs []netip.Prefix `json:"allowed_ips"`
+}
+
+func (config *Config) ApplyWstunnelHostExclusions() ([]netip.Prefix, error) {
+	return config.ApplyWstunnelHostExclusionsContext(context.Background())
+}
+
+// ApplyWstunnelHostExclusionsContext is like ApplyWstunnelHostExclusions, but
+// gives up resolving WSTUNNEL_HOST as soon as ctx is done, in which case config
+// is left unmodified and ctx.Err() is returned.
+func (config *Config) ApplyWstunnelHostExclusionsContext(ctx context.Context) ([]netip.Prefix, error) {
+	return config.applyExclusions(ctx, nil)
+}
+
+// ApplyExclusions is like ApplyWstunnelHostExclusions, but also excludes
+// extra, such as prefixes the caller computed itself, in the same pass, so
+// that AllowedIPs are only fragmented once. Unlike the WSTUNNEL_HOST
+// excludes, extra applies to every peer. It returns all excludes applied,
+// extra included.
+func (config *Config) ApplyExclusions(extra []netip.Prefix) ([]netip.Prefix, error) {
+	for _, p := range extra {
+		if !p.IsValid() {
+			return nil, errors.New("invalid extra exclude")
+		}
+	}
+	return config.applyExclusions(context.Background(), extra)
+}
+
+func (config *Config) applyExclusions(ctx context.Context, extra []netip.Prefix) ([]netip.Prefix, error) {
+	if config.wstunnelExclusionDisabled() {
+		return nil, nil
+	}
+	excluder := config.newWstunnelHostExcluder(ctx)
+	excluder.setExtra(extra)
+	excludes, diffs, err := excluder.compute()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return config.applyComputedExclusions(excludes, excluder.extra, diffs, err)
+}
+
+// applyComputedExclusions applies excludes and diffs, as computed along with
+// err by a wstunnelHostExcluder with extra, to config.
+func (config *Config) applyComputedExclusions(excludes, extra []netip.Prefix, diffs []PeerAllowedIPsDiff, err error) ([]netip.Prefix, error) {
+	if done, err := config.beginWstunnelHostExclusions(excludes, extra, err); done {
+		return nil, err
+	}
+	for i := range diffs {
+		if checkErr := checkPeerAllowedIPsDiff(&diffs[i], excludes); checkErr != nil {
+			return nil, errors.Join(err, checkErr)
+		}
+	}
+	for _, diff := range diffs {
+		warnFragmentedAllowedIPs(diff)
+	}
+	removed := new(big.Int)
+	changedPeers := 0
+	for _, diff := range diffs {
+		if config.applyPeerAllowedIPsDiff(diff) {
+			removed.Add(removed, addressesRemoved(diff.Before, diff.After))
+			changedPeers++
+		}
+	}
+	if DebugLogger != nil {
+		DebugLogger("%s", formatExclusionReport(diffs))
+	}
+	if changedPeers > 0 && WarnOverlappingAllowedIPs {
+		for _, overlap := range config.FindOverlappingAllowedIPs() {
+			Logger("Warning: AllowedIPs %s are routed by both peer %d and peer %d", overlap.Prefix, overlap.PeerA+1, overlap.PeerB+1)
+		}
+	}
+	wstunnelStats.excludesApplied.Add(uint64(len(excludes)))
+	Logger("WSTUNNEL_HOST excluded %d prefix(es) totaling %s address(es) from %d peer(s)", len(excludes), FormatAddressCount(removed), changedPeers)
+	return excludes, err
+}
+
+// ApplyWstunnelHostExclusionsStream is like ApplyWstunnelHostExclusions, but
+// computes and applies the exclusions one peer at a time, calling fn for each
+// peer once its AllowedIPs are updated, so that memory does not grow with the
+// number of peers. Unlike ApplyWstunnelHostExclusions, it does not look for
+// AllowedIPs shared by peers, and if a peer fails the checks, the peers before
+// it keep their new AllowedIPs.
+func (config *Config) ApplyWstunnelHostExclusionsStream(fn func(peerIndex int, before, after []netip.Prefix)) ([]netip.Prefix, error) {
+	if config.wstunnelExclusionDisabled() {
+		return nil, nil
+	}
+	excluder := config.newWstunnelHostExcluder(context.Background())
+	excludes := excluder.allExcludes()
+	if done, err := config.beginWstunnelHostExclusions(excludes, nil, errors.Join(excluder.errs...)); done {
+		return nil, err
+	}
+	removed := new(big.Int)
+	changedPeers := 0
+	for i := range config.Peers {
+		diff, ok, err := excluder.peerDiff(i)
+		if err == nil && ok {
+			err = checkPeerAllowedIPsDiff(&diff, excludes)
+		}
+		if err != nil {
+			return nil, errors.Join(append(excluder.errs, err)...)
+		}
+		if !ok {
+			continue
+		}
+		warnFragmentedAllowedIPs(diff)
+		if config.applyPeerAllowedIPsDiff(diff) {
+			removed.Add(removed, addressesRemoved(diff.Before, diff.After))
+			changedPeers++
+		}
+		if fn != nil {
+			fn(diff.Peer, diff.Before, diff.After)
+		}
+	}
+	wstunnelStats.excludesApplied.Add(uint64(len(excludes)))
+	Logger("WSTUNNEL_HOST excluded %d prefix(es) totaling %s address(es) from %d peer(s)", len(excludes), FormatAddressCount(removed), changedPeers)
+	return excludes, errors.Join(excluder.errs...)
+}
+
+// wstunnelExclusionDisabled reports whether WSTUNNEL_DISABLE_EXCLUSION is
+// set, logging that WSTUNNEL_HOST is therefore not excluded.
+func (config *Config) wstunnelExclusionDisabled() bool {
+	if !config.Interface.WstunnelDisableExclusion {
+		return false
+	}
+	Logger("WSTUNNEL_HOST exclusions are disabled by WSTUNNEL_DISABLE_EXCLUSION, so AllowedIPs are left unchanged")
+	return true
+}
+
+// beginWstunnelHostExclusions handles the outcomes of resolving WSTUNNEL_HOST
+// for which there is nothing to apply, returning done and the error to
+// return, and otherwise logs the notes about the excludes, which include
+// extra.
+func (config *Config) beginWstunnelHostExclusions(excludes, extra []netip.Prefix, err error) (done bool, _ error) {
+	if errors.Is(err, errWstunnelHostAbandoned) {
+		Logger("Warning: %v, so AllowedIPs are left without exclusions", err)
+		config.ResetWstunnelHostExclusions()
+		return true, nil
+	}
+	if len(excludes) == 0 {
+		if err == nil {
+			config.ResetWstunnelHostExclusions()
+		}
+		return true, err
+	}
+	if len(extra) > 0 {
+		Logger("WSTUNNEL_HOST and extra excludes: %s", prefixListToString(excludes))
+	} else {
+		Logger("WSTUNNEL_HOST excludes: %s", prefixListToString(excludes))
+	}
+	// Extra excludes are not expected to match an endpoint.
+	if unmatched := config.excludesWithoutEndpoint(disjointPrefixes(excludes, extra)); len(unmatched) > 0 {
+		Logger("Warning: WSTUNNEL_HOST excludes %s do not match any peer endpoint", prefixListToString(unmatched))
+	}
+	var allowedIPs []netip.Prefix
+	for i := range config.Peers {
+		allowedIPs = append(allowedIPs, config.Peers[i].baselineAllowedIPs()...)
+	}
+	if len(allowedIPs) == 0 {
+		Logger("WSTUNNEL_HOST is set, but no peer has AllowedIPs to exclude it from, so the configuration may be incomplete")
+		return false, nil
+	}
+	if unmatched := config.excludesWithoutFamily(excludes); len(unmatched) > 0 {
+		Logger("WSTUNNEL_HOST excludes %s have no effect, since no peer AllowedIPs are of that address family", prefixListToString(unmatched))
+	}
+	routes4, routes6 := prefixFamilies(allowedIPs)
+	if have4, have6 := prefixFamilies(excludes); !have6 && routes6 {
+		Logger("WSTUNNEL_HOST excludes are IPv4 only, so IPv6 AllowedIPs are unaffected")
+	} else if !have4 && routes4 {
+		Logger("WSTUNNEL_HOST excludes are IPv6 only, so IPv4 AllowedIPs are unaffected")
+	}
+	return false, nil
+}
+
+// checkPeerAllowedIPsDiff applies EmptiedAllowedIPs and
+// MaxAllowedIPsAfterExclusion to diff.
+func checkPeerAllowedIPsDiff(diff *PeerAllowedIPsDiff, excludes []netip.Prefix) error {
+	if VerifyExclusionSubset {
+		if gained := gainedPrefixes(diff.Before, diff.After); len(gained) > 0 {
+			err := fmt.Errorf("WSTUNNEL_HOST exclusions added %s to AllowedIPs %s of peer %d", prefixListToString(gained), prefixListToString(diff.Before), diff.Peer+1)
+			Logger("Internal error: %v", err)
+			return err
+		}
+	}
+	if len(diff.After) == 0 {
+		offenders := prefixListToString(overlappingPrefixes(excludes, diff.Before))
+		emptied := fmt.Errorf("WSTUNNEL_HOST excludes %s remove all AllowedIPs of peer %d", offenders, diff.Peer+1)
+		switch EmptiedAllowedIPs {
+		case SkipEmptiedAllowedIPs:
+			Logger("Warning: %v, so its AllowedIPs are left unchanged", emptied)
+			diff.After = append([]netip.Prefix(nil), diff.Before...)
+			return nil
+		case RejectEmptiedAllowedIPs:
+			return emptied
+		default:
+			Logger("Warning: %v, so it no longer routes any traffic", emptied)
+			return nil
+		}
+	}
+	if MaxAllowedIPsAfterExclusion > 0 && len(diff.After) > MaxAllowedIPsAfterExclusion {
+		return fmt.Errorf("WSTUNNEL_HOST exclusions leave peer %d with %d AllowedIPs, more than the limit of %d", diff.Peer+1, len(diff.After), MaxAllowedIPsAfterExclusion)
+	}
+	return nil
+}
+
+// gainedPrefixes returns the prefixes of after that are not entirely within
+// before.
+func gainedPrefixes(before, after []netip.Prefix) []netip.Prefix {
+	before = unionPrefixList(unmapPrefixList(before), nil)
+	var gained []netip.Prefix
+	for _, p := range unmapPrefixList(after) {
+		within := intersectPrefixList([]netip.Prefix{p}, before)
+		if prefixListAddressCount(within).Cmp(prefixListAddressCount([]netip.Prefix{p})) != 0 {
+			gained = append(gained, p)
+		}
+	}
+	return gained
+}
+
+func warnFragmentedAllowedIPs(diff PeerAllowedIPsDiff) {
+	for _, base := range diff.Before {
+		if n := fragmentCount(base, diff.After); FragmentWarningThreshold > 0 && n > FragmentWarningThreshold {
+			Logger("Warning: WSTUNNEL_HOST exclusions split AllowedIPs %s of peer %d into %d prefixes", base, diff.Peer+1, n)
+		}
+	}
+}
+
+// applyPeerAllowedIPsDiff stores diff in its peer and reports whether that
+// changed its AllowedIPs.
+func (config *Config) applyPeerAllowedIPsDiff(diff PeerAllowedIPsDiff) bool {
+	if config.Peers[diff.Peer].OriginalAllowedIPs == nil {
+		config.Peers[diff.Peer].OriginalAllowedIPs = diff.Before
+	}
+	config.Peers[diff.Peer].AllowedIPs = diff.After
+	before := prefixListToString(diff.Before)
+	after := prefixListToString(diff.After)
+	if before == after {
+		return false
+	}
+	Logger("AllowedIPs updated for peer %d: %s -> %s", diff.Peer+1, before, after)
+	if OnExclusionApplied != nil {
+		OnExclusionApplied(diff.Peer, diff.Before, diff.After)
+	}
+	return true
+}
+
+func (config *Config) ResetWstunnelHostExclusions() {
+	for i := range config.Peers {
+		if config.Peers[i].OriginalAllowedIPs == nil {
+			continue
+		}
+		config.Peers[i].AllowedIPs = config.Peers[i].OriginalAllowedIPs
+		config.Peers[i].OriginalAllowedIPs = nil
+	}
+}
+
+func (peer *Peer) baselineAllowedIPs() []netip.Prefix {
+	if peer.OriginalAllowedIPs != nil {
+		return peer.OriginalAllowedIPs
+	}
+	return peer.AllowedIPs
+}
+
+func (config *Config) CheckWstunnelLocalPort() bool {
+	if config.Interface.WstunnelLocalPort == 0 {
+		return true
+	}
+	ok := true
+	for i := range config.Peers {
+		endpoint := &config.Peers[i].Endpoint
+		if endpoint.IsEmpty() {
+			continue
+		}
+		if endpoint.Port != config.Interface.WstunnelLocalPort || !isLoopbackHost(endpoint.Host) {
+			Logger("Warning: endpoint %s of peer %d does not point at the local wstunnel listener on port %d", endpoint.String(), i+1, config.Interface.WstunnelLocalPort)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// excludesWithoutEndpoint returns the excludes that contain no peer endpoint
+// address. Endpoints that are unresolved or loopback, as when pointing at a
+// local wstunnel client, are not considered, and if no endpoint remains,
+// nothing is reported.
+func (config *Config) excludesWithoutEndpoint(excludes []netip.Prefix) []netip.Prefix {
+	var endpoints []netip.Addr
+	for i := range config.Peers {
+		addr, err := netip.ParseAddr(config.Peers[i].Endpoint.Host)
+		if err != nil || addr.Unmap().IsLoopback() {
+			continue
+		}
+		endpoints = append(endpoints, addr.Unmap())
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	var unmatched []netip.Prefix
+	for _, e := range excludes {
+		matched := false
+		for _, addr := range endpoints {
+			if e.Contains(addr) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, e)
+		}
+	}
+	return unmatched
+}
+
+// prefixFamilies reports whether prefixes contain IPv4 and IPv6 prefixes.
+func prefixFamilies(prefixes []netip.Prefix) (have4, have6 bool) {
+	for _, p := range prefixes {
+		if p.Addr().Unmap().Is4() {
+			have4 = true
+		} else {
+			have6 = true
+		}
+	}
+	return
+}
+
+// excludesWithoutFamily returns the excludes of an address family that no
+// peer routes at all, which therefore cannot change any AllowedIPs.
+func (config *Config) excludesWithoutFamily(excludes []netip.Prefix) []netip.Prefix {
+	var have4, have6 bool
+	for i := range config.Peers {
+		for _, p := range config.Peers[i].baselineAllowedIPs() {
+			if p.Addr().Unmap().Is4() {
+				have4 = true
+			} else {
+				have6 = true
+			}
+		}
+	}
+	var unmatched []netip.Prefix
+	for _, e := range excludes {
+		if is4 := e.Addr().Is4(); (is4 && !have4) || (!is4 && !have6) {
+			unmatched = append(unmatched, e)
+		}
+	}
+	return unmatched
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+func (config *Config) PreviewWstunnelHostExclusions() ([]PeerAllowedIPsDiff, error) {
+	_, diffs, err := config.computeWstunnelHostExclusions(context.Background())
+	return diffs, err
+}
+
+// WstunnelExcludes returns the sorted, deduplicated prefixes that
+// ApplyWstunnelHostExclusions would remove from the peers' AllowedIPs,
+// without changing the peers.
+func (config *Config) WstunnelExcludes() ([]netip.Prefix, error) {
+	excludes, _, err := config.computeWstunnelHostExclusions(context.Background())
+	return excludes, err
+}
+
+// WstunnelBypass describes the wstunnel server as the host addresses that
+// WSTUNNEL_HOST excludes and the port it is reached on, if known, so that a
+// route narrower than an AllowedIPs exclusion can be installed for it.
+type WstunnelBypass struct {
+	Addrs []netip.Addr
+	Port  uint16
+}
+
+// WstunnelBypass returns the bypass for the WSTUNNEL_HOST excludes that are
+// single addresses, with the port of the interface's WSTUNNEL_HOST. Excluded
+// networks do not name a host, so they are left out.
+func (config *Config) WstunnelBypass() (WstunnelBypass, error) {
+	excludes, err := config.WstunnelExcludes()
+	bypass := WstunnelBypass{Port: config.Interface.WstunnelPort}
+	for _, e := range excludes {
+		if e.IsSingleIP() {
+			bypass.Addrs = append(bypass.Addrs, e.Addr())
+		}
+	}
+	return bypass, err
+}
+
+// PreviewWstunnelHostExclusionReport is like PreviewWstunnelHostExclusions,
+// but describes each peer in a form meant to be marshaled to JSON.
+func (config *Config) PreviewWstunnelHostExclusionReport() ([]PeerExclusionReport, error) {
+	diffs, err := config.PreviewWstunnelHostExclusions()
+	reports := make([]PeerExclusionReport, 0, len(diffs))
+	for _, diff := range diffs {
+		removed, subtractErr := subtractPrefixList(diff.Before, diff.After)
+		if subtractErr != nil {
+			return nil, errors.Join(err, subtractErr)
+		}
+		report := PeerExclusionReport{
+			Peer:       diff.Peer,
+			Removed:    append([]netip.Prefix{}, removed...),
+			AllowedIPs: append([]netip.Prefix{}, diff.After...),
+		}
+		if key := &config.Peers[diff.Peer].PublicKey; !key.IsZero() {
+			report.PublicKey = key.String()
+		}
+		reports = append(reports, report)
+	}
+	return reports, err
+}
+
+// ExcludeEffect says whether a WSTUNNEL_HOST exclude changes routing, which
+// it does when it removes addresses from the AllowedIPs of some peer, or is a
+// no-op.
+type ExcludeEffect struct {
+	Prefix  netip.Prefix `json:"prefix"`
+	Applied bool         `json:"applied"`
+}
+
+// PreviewWstunnelExcludeEffects returns the excludes that
+// ApplyWstunnelHostExclusions would apply, each with whether it would change
+// the AllowedIPs of any peer, to help prune entries that have no effect.
+func (config *Config) PreviewWstunnelExcludeEffects() ([]ExcludeEffect, error) {
+	excludes, diffs, err := config.computeWstunnelHostExclusions(context.Background())
+	var removed []netip.Prefix
+	for _, diff := range diffs {
+		gone, subtractErr := subtractPrefixList(diff.Before, diff.After)
+		if subtractErr != nil {
+			return nil, errors.Join(err, subtractErr)
+		}
+		removed = append(removed, gone...)
+	}
+	effects := make([]ExcludeEffect, 0, len(excludes))
+	for _, e := range excludes {
+		effects = append(effects, ExcludeEffect{
+			Prefix:  e,
+			Applied: len(overlappingPrefixes([]netip.Prefix{e}, removed)) > 0,
+		})
+	}
+	return effects, err
+}
+
+// computeWstunnelHostExclusions returns the union of all excludes along with
+// the AllowedIPs each peer would have after subtracting the excludes of its
+// own WSTUNNEL_HOST, or of the interface's if it has none.
+func (config *Config) computeWstunnelHostExclusions(ctx context.Context) ([]netip.Prefix, []PeerAllowedIPsDiff, error) {
+	return config.newWstunnelHostExcluder(ctx).compute()
+}
+
+func (excluder *wstunnelHostExcluder) compute() ([]netip.Prefix, []PeerAllowedIPsDiff, error) {
+	config := excluder.config
+	all := excluder.allExcludes()
+	diffs := make([]PeerAllowedIPsDiff, 0, len(config.Peers))
+	for i := range config.Peers {
+		diff, ok, err := excluder.peerDiff(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			diffs = append(diffs, diff)
+		}
+	}
+	err := errors.Join(excluder.errs...)
+	if len(all) == 0 {
+		return nil, nil, err
+	}
+	return all, diffs, err
+}
+
+// wstunnelHostExcluder resolves each distinct WSTUNNEL_HOST of a config once,
+// collecting the errors, and subtracts the excludes, along with extra, from
+// peers.
+type wstunnelHostExcluder struct {
+	ctx    context.Context
+	config *Config
+	extra  []netip.Prefix
+	parsed map[string][]netip.Prefix
+	errs   []error
+}
+
+func (config *Config) newWstunnelHostExcluder(ctx context.Context) *wstunnelHostExcluder {
+	return &wstunnelHostExcluder{
+		ctx:    context.WithValue(ctx, wstunnelHostEndpointsKey{}, config.Peers),
+		config: config,
+		parsed: make(map[string][]netip.Prefix),
+	}
+}
+
+// setExtra sets the excludes that apply to every peer in addition to those of
+// its WSTUNNEL_HOST.
+func (excluder *wstunnelHostExcluder) setExtra(extra []netip.Prefix) {
+	if len(extra) == 0 {
+		return
+	}
+	masked := make([]netip.Prefix, 0, len(extra))
+	for _, p := range extra {
+		masked = append(masked, unmapPrefix(p.Masked()))
+	}
+	masked = filterExcludeFamilies(masked)
+	sortPrefixes(masked)
+	excluder.extra = dedupeSortedPrefixes(masked)
+}
+
+func (excluder *wstunnelHostExcluder) excludesOf(s string) []netip.Prefix {
+	if excludes, ok := excluder.parsed[s]; ok {
+		return excludes
+	}
+	excludes, err := parseWstunnelHostExcludesContext(excluder.ctx, s)
+	if err != nil {
+		excluder.errs = append(excluder.errs, err)
+	}
+	excludes = append(excludes, excluder.config.dnsExcludes()...)
+	excludes = filterExcludeFamilies(excludes)
+	excludes = append(excludes, excluder.extra...)
+	sortPrefixes(excludes)
+	excludes = dedupeSortedPrefixes(excludes)
+	excluder.parsed[s] = excludes
+	return excludes
+}
+
+// hostOf returns the WSTUNNEL_HOST that applies to peer i, which is blank if
+// there is none.
+func (excluder *wstunnelHostExcluder) hostOf(i int) string {
+	if host := excluder.config.Peers[i].WstunnelHost; strings.TrimSpace(host) != "" {
+		return host
+	}
+	return excluder.config.Interface.WstunnelHost
+}
+
+// otherExcludes returns the excludes of every peer that do not come from
+// WSTUNNEL_HOST, which are extra and the Interface DNS servers.
+func (excluder *wstunnelHostExcluder) otherExcludes() []netip.Prefix {
+	excludes := filterExcludeFamilies(excluder.config.dnsExcludes())
+	excludes = append(excludes, excluder.extra...)
+	sortPrefixes(excludes)
+	return dedupeSortedPrefixes(excludes)
+}
+
+// allExcludes returns the union of the excludes of the interface and of all
+// peers, and extra.
+func (excluder *wstunnelHostExcluder) allExcludes() []netip.Prefix {
+	var all []netip.Prefix
+	if len(excluder.extra) > 0 {
+		all = append(all, excluder.otherExcludes()...)
+	}
+	if strings.TrimSpace(excluder.config.Interface.WstunnelHost) != "" {
+		all = append(all, excluder.excludesOf(excluder.config.Interface.WstunnelHost)...)
+	}
+	for i := range excluder.config.Peers {
+		if host := excluder.hostOf(i); strings.TrimSpace(host) != "" {
+			all = append(all, excluder.excludesOf(host)...)
+		}
+	}
+	sortPrefixes(all)
+	return dedupeSortedPrefixes(all)
+}
+
+// peerDiff returns the AllowedIPs of peer i before and after exclusion, or
+// false if it has nothing to change.
+func (excluder *wstunnelHostExcluder) peerDiff(i int) (PeerAllowedIPsDiff, bool, error) {
+	peer := &excluder.config.Peers[i]
+	host := excluder.hostOf(i)
+	var excludes []netip.Prefix
+	switch {
+	case strings.TrimSpace(host) != "":
+		excludes = excluder.excludesOf(host)
+	case len(excluder.extra) > 0:
+		excludes = excluder.otherExcludes()
+	case peer.OriginalAllowedIPs != nil:
+		return PeerAllowedIPsDiff{
+			Peer:   i,
+			Before: append([]netip.Prefix(nil), peer.OriginalAllowedIPs...),
+			After:  append([]netip.Prefix(nil), peer.OriginalAllowedIPs...),
+		}, true, nil
+	default:
+		return PeerAllowedIPsDiff{}, false, nil
+	}
+	baseline := peer.baselineAllowedIPs()
+	if len(baseline) == 0 {
+		return PeerAllowedIPsDiff{}, false, nil
+	}
+	if WstunnelExcludeDefaultRouteOnly && !hasDefaultRoute(baseline) {
+		if DebugLogger != nil {
+			DebugLogger("Peer %d has no default route, so WSTUNNEL_HOST is not excluded from it", i+1)
+		}
+		excludes = excluder.otherExcludes()
+	}
+	// Most peers route only private ranges while the wstunnel server is
+	// public, so skip the subtraction when there is nothing to carve.
+	if len(overlappingPrefixes(excludes, unmapPrefixList(baseline))) == 0 {
+		return PeerAllowedIPsDiff{
+			Peer:   i,
+			Before: append([]netip.Prefix(nil), baseline...),
+			After:  append([]netip.Prefix(nil), baseline...),
+		}, true, nil
+	}
+	after, err := subtractPrefixList(baseline, excludes)
+	if err != nil {
+		return PeerAllowedIPsDiff{}, false, fmt.Errorf("unable to exclude WSTUNNEL_HOST from AllowedIPs of peer %d: %w", i+1, err)
+	}
+	return PeerAllowedIPsDiff{
+		Peer:   i,
+		Before: append([]netip.Prefix(nil), baseline...),
+		After:  after,
+	}, true, nil
+}
+
+// hasDefaultRoute reports whether prefixes include 0.0.0.0/0 or ::/0.
+func hasDefaultRoute(prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// filterExcludeFamilies drops the excludes outside WstunnelExcludeFamilies.
+func filterExcludeFamilies(excludes []netip.Prefix) []netip.Prefix {
+	var kept, ignored []netip.Prefix
+	for _, e := range excludes {
+		if WstunnelExcludeFamilies.contains(e.Addr()) {
+			kept = append(kept, e)
+		} else {
+			ignored = append(ignored, e)
+		}
+	}
+	if len(ignored) > 0 {
+		Logger("WSTUNNEL_HOST excludes %s are of an address family that is not processed, so they are ignored", prefixListToString(ignored))
+	}
+	return kept
+}
+
+// dnsExcludes returns the Interface DNS servers as single-address prefixes
+// when WSTUNNEL_EXCLUDE_DNS is set, so that they stay reachable outside the
+// tunnel alongside the wstunnel host. Names given as DNS always end up in
+// DNSSearch as search domains, since Windows takes resolvers only by address,
+// so there are no named servers to resolve here.
+func (config *Config) dnsExcludes() []netip.Prefix {
+	if !config.Interface.WstunnelExcludeDNS {
+		return nil
+	}
+	excludes := make([]netip.Prefix, 0, len(config.Interface.DNS))
+	for _, addr := range config.Interface.DNS {
+		if addr.IsValid() {
+			excludes = append(excludes, prefixFromAddr(addr.Unmap()))
+		}
+	}
+	return excludes
+}
+
+func (config *Config) RestoreWstunnelHostExclusions(excludes []netip.Prefix) {
+	for i := range config.Peers {
+		if len(config.Peers[i].AllowedIPs) == 0 {
+			continue
+		}
+		restore := carvedPrefixes(config.Peers[i].AllowedIPs, excludes)
+		if len(restore) > 0 {
+			config.Peers[i].AllowedIPs = unionPrefixList(config.Peers[i].AllowedIPs, restore)
+		}
+	}
+}
+
+// carvedPrefixes returns the excludes that look like they were subtracted from
+// allowed: the sibling of each coalesced exclude must still be routed, either
+// directly or via another carved exclude next to it.
+func carvedPrefixes(allowed, excludes []netip.Prefix) []netip.Prefix {
+	var carved []netip.Prefix
+	pending := make([]netip.Prefix, 0, len(excludes))
+	for _, e := range unionPrefixList(nil, excludes) {
+		if e.Bits() > 0 {
+			pending = append(pending, e)
+		}
+	}
+	for {
+		routed := append(append([]netip.Prefix(nil), allowed...), carved...)
+		remaining := pending[:0]
+		for _, e := range pending {
+			if prefixListCovers(routed, siblingPrefix(e)) {
+				carved = append(carved, e)
+			} else {
+				remaining = append(remaining, e)
+			}
+		}
+		if len(remaining) == len(pending) {
+			return carved
+		}
+		pending = remaining
+	}
+}
+
+// fragmentCount returns how many of the prefixes in after lie within base.
+func fragmentCount(base netip.Prefix, after []netip.Prefix) int {
+	base = unmapPrefix(base).Masked()
+	n := 0
+	for _, p := range after {
+		if p.Bits() >= base.Bits() && base.Contains(p.Addr()) {
+			n++
+		}
+	}
+	return n
+}
+
+func prefixListCovers(prefixes []netip.Prefix, target netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() <= target.Bits() && p.Contains(target.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutesAddr reports which peer's AllowedIPs route addr into the tunnel. As
+// with the routing table, the most specific prefix wins, and as in WireGuard,
+// ties go to the last peer.
+func (config *Config) RoutesAddr(addr netip.Addr) (peerIndex int, ok bool) {
+	addr = addr.Unmap().WithZone("")
+	bits := -1
+	for i := range config.Peers {
+		for _, p := range config.Peers[i].AllowedIPs {
+			p = unmapPrefix(p)
+			if p.Bits() >= bits && p.Contains(addr) {
+				peerIndex, bits = i, p.Bits()
+			}
+		}
+	}
+	if bits < 0 {
+		return 0, false
+	}
+	return peerIndex, true
+}
+
+// Overlap is a prefix routed by two peers. PeerA and PeerB are indices into
+// Config.Peers, with PeerA < PeerB.
+type Overlap struct {
+	PeerA  int
+	PeerB  int
+	Prefix netip.Prefix
+}
+
+// FindOverlappingAllowedIPs returns the prefixes routed by more than one peer,
+// for each pair of peers. WireGuard gives such addresses to whichever peer was
+// configured last, which after exclusions fragment AllowedIPs is easily
+// surprising.
+func (config *Config) FindOverlappingAllowedIPs() []Overlap {
+	var overlaps []Overlap
+	for a := range config.Peers {
+		for b := a + 1; b < len(config.Peers); b++ {
+			shared := IntersectPrefixes(config.Peers[a].AllowedIPs, config.Peers[b].AllowedIPs)
+			for _, p := range unionPrefixList(shared, nil) {
+				overlaps = append(overlaps, Overlap{PeerA: a, PeerB: b, Prefix: p})
+			}
+		}
+	}
+	return overlaps
+}
+
+// AllowedIPsDelta returns the addresses that b routes through the tunnel but
+// a does not, and those that a routes but b does not, such as when previewing
+// a change of WSTUNNEL_HOST.
+func AllowedIPsDelta(a, b *Config) (added, removed []netip.Prefix) {
+	routedA, routedB := a.routedPrefixes(), b.routedPrefixes()
+	added, _ = subtractPrefixList(routedB, routedA)
+	removed, _ = subtractPrefixList(routedA, routedB)
+	return added, removed
+}
+
+// routedPrefixes returns the union of the valid AllowedIPs of all peers.
+func (config *Config) routedPrefixes() []netip.Prefix {
+	var routed []netip.Prefix
+	for i := range config.Peers {
+		for _, p := range config.Peers[i].AllowedIPs {
+			if p.IsValid() {
+				routed = append(routed, p)
+			}
+		}
+	}
+	return unionPrefixList(unmapPrefixList(routed), nil)
+}
+
+func (config *Config) DeriveEndpointExcludes() ([]netip.Prefix, error) {
+	var excludes []netip.Prefix
+	var errs []error
+	for i := range config.Peers {
+		endpoint := &config.Peers[i].Endpoint
+		if endpoint.IsEmpty() || isLoopbackHost(endpoint.Host) {
+			continue
+		}
+		prefixes, err := resolveExcludeHost(context.Background(), endpoint.Host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to resolve endpoint of peer %d: %w", i+1, err))
+			continue
+		}
+		excludes = append(excludes, prefixes...)
+	}
+	sortPrefixes(excludes)
+	return dedupeSortedPrefixes(excludes), errors.Join(errs...)
+}
+
+func overlappingPrefixes(prefixes, others []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		for _, o := range others {
+			if p.Overlaps(o) {
+				out = append(out, p)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// disjointPrefixes returns the prefixes that overlap none of others.
+func disjointPrefixes(prefixes, others []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		if len(overlappingPrefixes([]netip.Prefix{p}, others)) == 0 {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// parseWstunnelHostExcludes returns the prefixes that WSTUNNEL_HOST removes
+// from AllowedIPs. An entry prefixed with ! is kept in the tunnel instead: it
+// takes precedence over every other entry regardless of their order, so its
+// addresses are never excluded, but it does not add routes to a peer whose
+// AllowedIPs did not already cover it. An env:NAME entry is replaced by the
+// value of the environment variable NAME before it is parsed, @gateway stands
+// for the addresses of the system's default gateways, @endpoint:N for the
+// endpoint of peer N, or of the first peer without :N, asn:NAME for the
+// prefixes returned by the resolver set with SetNamedPrefixSetResolver, and
+// hosts:ALIAS for the addresses the hosts file maps ALIAS to.
+func parseWstunnelHostExcludes(s string) ([]netip.Prefix, error) {
+	return parseWstunnelHostExcludesContext(context.Background(), s)
+}
+
+func parseWstunnelHostExcludesContext(ctx context.Context, s string) ([]netip.Prefix, error) {
+	spec, err := parseWstunnelHostSpec(s)
+	if err != nil {
+		return nil, err
+	}
+	entryErrs, err := spec.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	excludes := make([]netip.Prefix, 0, len(spec.Entries))
+	var keeps []netip.Prefix
+	var errs []error
+	for i := range spec.Entries {
+		entry := &spec.Entries[i]
+		prefixes := entry.Prefixes
+		if err := entryErrs[i]; err != nil {
+			unresolvable := errors.Is(err, ErrWstunnelHostUnresolvable)
+			switch {
+			case unresolvable && WstunnelUnresolvablePolicy == SkipUnresolvableWstunnelHost:
+				// Whatever did resolve, such as the other lines of an
+				// @file entry, is still excluded.
+				Logger("Warning: unable to exclude %v, so skipping it", err)
+			case unresolvable && WstunnelUnresolvablePolicy == SkipAllUnresolvableWstunnelHost:
+				return nil, fmt.Errorf("%w: %w", errWstunnelHostAbandoned, err)
+			default:
+				Logger("Unable to exclude %v", err)
+				errs = append(errs, err)
+			}
+		} else if DebugLogger != nil {
+			DebugLogger("WSTUNNEL_HOST entry %q %s", entry.part, describeWstunnelHostEntry(&entry.parsed, prefixes))
+		}
+		if entry.Keep {
+			keeps = append(keeps, prefixes...)
+			continue
+		}
+		if local := localPrefixes(prefixes); len(local) > 0 {
+			localErr := fmt.Errorf("WSTUNNEL_HOST %q refers to local address %s rather than the remote wstunnel server", entry.part, prefixListToString(local))
+			if RejectLocalWstunnelHost {
+				localErr = fmt.Errorf("WSTUNNEL_HOST entry %d of %d: %w", i+1, len(spec.Entries), &WstunnelHostError{Entry: entry.part, Err: localErr})
+				Logger("Unable to exclude %v", localErr)
+				errs = append(errs, localErr)
+				continue
+			}
+			Logger("Warning: %v, so excluding it has no effect", localErr)
+		}
+		excludes = append(excludes, prefixes...)
+	}
+	if len(keeps) > 0 {
+		// Subtracting what to keep from the excludes up front is the same as
+		// adding it back to each peer afterwards, and avoids fragmenting
+		// AllowedIPs only to coalesce them again.
+		excludes, err = subtractPrefixList(excludes, keeps)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return dedupePrefixes(excludes), errors.Join(errs...)
+}
+
+// describeWstunnelHostEntry says whether entry was a literal address or
+// prefix, or else what it resolved to.
+func describeWstunnelHostEntry(entry *wstunnelHostEntry, prefixes []netip.Prefix) string {
+	switch {
+	case entry.form == formPrefix:
+		return fmt.Sprintf("is the prefix %s", entry.prefixes[0].Masked())
+	case entry.form == formRange:
+		return fmt.Sprintf("is the range %s-%s, covered by %s", entry.from, entry.to, prefixListToString(prefixes))
+	case entry.form == formHost && entry.addr.IsValid():
+		return fmt.Sprintf("is the address %s", entry.addr.WithZone(""))
+	}
+	resolved := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsSingleIP() {
+			resolved = append(resolved, p.Addr().String())
+		} else {
+			resolved = append(resolved, p.String())
+		}
+	}
+	if len(resolved) == 0 {
+		return "resolved to nothing"
+	}
+	return "resolved to " + strings.Join(resolved, ", ")
+}
+
+// localPrefixes returns the prefixes that cover loopback or link-local
+// addresses, or that are the unspecified address, none of which are ever
+// routed through the tunnel.
+func localPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		addr := p.Addr()
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() || (addr.IsUnspecified() && p.IsSingleIP()) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// wstunnelHostForm is the syntax of a WSTUNNEL_HOST entry.
+type wstunnelHostForm int
+
+const (
+	formHost       wstunnelHostForm = iota // HOST, HOST:PORT, [ADDR]:PORT or a URL
+	formPrefix                             // ADDR/BITS
+	formMaskedHost                         // HOST/BITS
+	formRange                              // START-END
+	formEnv                                // env:NAME
+	formBraces                             // with {FIRST..LAST} ranges
+	formAutoSubnet                         // auto-subnet:HOST
+	formHostsAlias                         // hosts:ALIAS
+	formGateway                            // @gateway
+	formEndpoint                           // @endpoint or @endpoint:N
+	formNamedSet                           // asn:NAME
+	formFile                               // @FILE
+)
+
+// wstunnelHostEntry is a WSTUNNEL_HOST entry whose syntax has been checked,
+// holding what resolving it needs.
+type wstunnelHostEntry struct {
+	text string
+	form wstunnelHostForm
+	// host and port are those of formHost, and host that of formMaskedHost.
+	host string
+	port uint16
+	// addr is the host of formHost when it is a literal address.
+	addr netip.Addr
+	// name is the variable of formEnv, the alias of formHostsAlias, the set
+	// of formNamedSet or the path of formFile.
+	name     string
+	bits     int
+	peer     int
+	from, to netip.Addr
+	// prefixes are those of formPrefix and formRange.
+	prefixes []netip.Prefix
+	// children are the expansions of formBraces, or the host of
+	// formAutoSubnet.
+	children []wstunnelHostEntry
+}
+
+// parseWstunnelHostEntry checks the syntax of a single WSTUNNEL_HOST entry,
+// without a leading !, and returns its form. Nothing is resolved or read, and
+// env:NAME entries are only expanded when resolved.
+func parseWstunnelHostEntry(part string) (wstunnelHostEntry, error) {
+	entry := wstunnelHostEntry{text: part}
+	if name, ok := wstunnelHostEnvName(part); ok {
+		entry.form, entry.name = formEnv, name
+		return entry, nil
+	}
+	if names, ok, err := expandWstunnelHostBraces(part); ok {
+		if err != nil {
+			return entry, err
+		}
+		entry.form = formBraces
+		entry.children = make([]wstunnelHostEntry, 0, len(names))
+		for _, name := range names {
+			child, err := parseWstunnelHostEntry(name)
+			if err != nil {
+				return entry, err
+			}
+			entry.children = append(entry.children, child)
+		}
+		return entry, nil
+	}
+	if host, ok := wstunnelHostAutoSubnet(part); ok {
+		child, err := parseWstunnelHostEntry(host)
+		if err != nil {
+			return entry, err
+		}
+		if child.form != formHost {
+			return entry, fmt.Errorf("invalid WSTUNNEL_HOST auto-subnet:%s: expected a hostname or address", host)
+		}
+		entry.form, entry.children = formAutoSubnet, []wstunnelHostEntry{child}
+		return entry, nil
+	}
+	if alias, ok := wstunnelHostsAlias(part); ok {
+		if err := validateWstunnelHostsAlias(alias); err != nil {
+			return entry, err
+		}
+		entry.form, entry.name = formHostsAlias, alias
+		return entry, nil
+	}
+	if isWstunnelHostGateway(part) {
+		entry.form = formGateway
+		return entry, nil
+	}
+	if peer, ok, err := wstunnelHostEndpointPeer(part); ok {
+		entry.form, entry.peer = formEndpoint, peer
+		return entry, err
+	}
+	if name, ok := wstunnelHostNamedSet(part); ok {
+		entry.form, entry.name = formNamedSet, name
+		return entry, nil
+	}
+	if from, to, ok, err := wstunnelHostRange(part); ok {
+		if err != nil {
+			return entry, err
+		}
+		entry.form, entry.from, entry.to, entry.prefixes = formRange, from, to, rangeToPrefixes(from, to)
+		return entry, nil
+	}
+	if path, ok := strings.CutPrefix(part, "@"); ok {
+		if len(path) == 0 {
+			return entry, errors.New("missing WSTUNNEL_HOST file name after @")
+		}
+		entry.form, entry.name = formFile, path
+		return entry, nil
+	}
+	if !strings.Contains(part, "://") && strings.Contains(part, "/") {
+		return entry, entry.parsePrefix()
+	}
+	host, port, err := splitWstunnelHost(part)
+	if err != nil {
+		return entry, err
+	}
+	entry.form, entry.host, entry.port = formHost, host, port
+	if addr, err := netip.ParseAddr(host); err == nil {
+		entry.addr = addr
+		return entry, nil
+	}
+	return entry, validateWstunnelHostname(host)
+}
+
+// parsePrefix parses the text of entry as ADDR/BITS or HOST/BITS.
+func (entry *wstunnelHostEntry) parsePrefix() error {
+	if p, err := netip.ParsePrefix(entry.text); err == nil {
+		entry.form, entry.prefixes = formPrefix, []netip.Prefix{p}
 		return nil
 	}
-	excludes, err := parseWstunnelHostExcludes(config.Interface.WstunnelHost)
+	slash := strings.LastIndexByte(entry.text, '/')
+	host, maskStr := entry.text[:slash], entry.text[slash+1:]
+	bits, err := strconv.ParseUint(maskStr, 10, 8)
+	if err != nil || len(host) == 0 {
+		return fmt.Errorf("invalid WSTUNNEL_HOST prefix %q", entry.text)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		// netip.ParsePrefix rejects zones, which don't matter for routing.
+		if len(addr.Zone()) == 0 || int(bits) > addr.BitLen() {
+			return fmt.Errorf("invalid WSTUNNEL_HOST prefix %q", entry.text)
+		}
+		entry.form, entry.prefixes = formPrefix, []netip.Prefix{netip.PrefixFrom(addr.WithZone(""), int(bits))}
+		return nil
+	}
+	if bits > 128 {
+		return fmt.Errorf("invalid WSTUNNEL_HOST mask /%d for %s", bits, host)
+	}
+	entry.form, entry.host, entry.bits = formMaskedHost, host, int(bits)
+	return validateWstunnelHostname(host)
+}
+
+// resolve returns the prefixes that entry stands for.
+func (entry *wstunnelHostEntry) resolve(ctx context.Context) ([]netip.Prefix, error) {
+	switch entry.form {
+	case formHost:
+		return resolveWstunnelHostEntry(ctx, entry.text, entry.host)
+	case formPrefix:
+		p := entry.prefixes[0]
+		if p != p.Masked() {
+			Logger("WSTUNNEL_HOST entry %s has host bits set, so it is interpreted as the network %s", entry.text, p.Masked())
+		}
+		return []netip.Prefix{unmapPrefix(p.Masked())}, nil
+	case formMaskedHost:
+		return resolveWstunnelHostMasked(ctx, entry.text, entry.host, entry.bits)
+	case formRange:
+		return entry.prefixes, nil
+	case formEnv:
+		value, err := expandWstunnelHostEnv(entry.name)
+		if err != nil {
+			return nil, err
+		}
+		expanded, err := parseWstunnelHostEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		return expanded.resolve(ctx)
+	case formBraces:
+		var prefixes []netip.Prefix
+		var errs []error
+		for i := range entry.children {
+			resolved, err := entry.children[i].resolve(ctx)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			prefixes = append(prefixes, resolved...)
+		}
+		return prefixes, errors.Join(errs...)
+	case formAutoSubnet:
+		return resolveWstunnelHostAutoSubnet(ctx, entry.text, &entry.children[0])
+	case formHostsAlias:
+		return resolveWstunnelHostsAlias(entry.text, entry.name)
+	case formGateway:
+		return resolveWstunnelHostGateway(entry.text)
+	case formEndpoint:
+		return resolveWstunnelHostEndpoint(ctx, entry.text, entry.peer)
+	case formNamedSet:
+		return resolveWstunnelHostNamedSet(entry.text, entry.name)
+	case formFile:
+		return parseWstunnelHostFile(ctx, entry.name)
+	}
+	return nil, fmt.Errorf("invalid WSTUNNEL_HOST %q", entry.text)
+}
+
+// hostPort returns the port given with the host of entry, or with the first
+// of its expansions that has one.
+func (entry *wstunnelHostEntry) hostPort() uint16 {
+	switch entry.form {
+	case formHost:
+		return entry.port
+	case formBraces, formAutoSubnet:
+		for i := range entry.children {
+			if port := entry.children[i].hostPort(); port != 0 {
+				return port
+			}
+		}
+	}
+	return 0
+}
+
+// maxWstunnelHostBraceExpansion is how many names a WSTUNNEL_HOST entry with
+// braces may expand to.
+const maxWstunnelHostBraceExpansion = 256
+
+// expandWstunnelHostBraces expands the numeric ranges in braces of part, such
+// as edge{1..4}.example.com, reporting whether it had any braces. As in shells,
+// a bound with leading zeros pads all numbers to the same width.
+func expandWstunnelHostBraces(part string) ([]string, bool, error) {
+	if !strings.ContainsAny(part, "{}") {
+		return nil, false, nil
+	}
+	names := []string{""}
+	rest := part
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if strings.Contains(rest[:open], "}") || end < 0 {
+			return nil, true, fmt.Errorf("unbalanced braces in WSTUNNEL_HOST %q", part)
+		}
+		end += open
+		first, last, ok := strings.Cut(rest[open+1:end], "..")
+		from, fromErr := strconv.ParseUint(first, 10, 32)
+		to, toErr := strconv.ParseUint(last, 10, 32)
+		if !ok || fromErr != nil || toErr != nil || from > to {
+			return nil, true, fmt.Errorf("invalid range {%s} in WSTUNNEL_HOST %q: expected {FIRST..LAST} with FIRST <= LAST", rest[open+1:end], part)
+		}
+		if uint64(len(names))*(to-from+1) > maxWstunnelHostBraceExpansion {
+			return nil, true, fmt.Errorf("WSTUNNEL_HOST %q expands to more than %d names", part, maxWstunnelHostBraceExpansion)
+		}
+		width := 0
+		if (len(first) > 1 && first[0] == '0') || (len(last) > 1 && last[0] == '0') {
+			width = len(last)
+			if len(first) > width {
+				width = len(first)
+			}
+		}
+		expanded := make([]string, 0, uint64(len(names))*(to-from+1))
+		for _, name := range names {
+			for n := from; n <= to; n++ {
+				expanded = append(expanded, fmt.Sprintf("%s%s%0*d", name, rest[:open], width, n))
+			}
+		}
+		names, rest = expanded, rest[end+1:]
+	}
+	if strings.Contains(rest, "}") {
+		return nil, true, fmt.Errorf("unbalanced braces in WSTUNNEL_HOST %q", part)
+	}
+	for i := range names {
+		names[i] += rest
+	}
+	return names, true, nil
+}
+
+// isWstunnelHostGateway reports whether part is the @gateway entry, which
+// takes precedence over a file called gateway; that can still be included as
+// @./gateway.
+func isWstunnelHostGateway(part string) bool {
+	return strings.EqualFold(part, "@gateway")
+}
+
+func resolveWstunnelHostGateway(entry string) ([]netip.Prefix, error) {
+	addrs, err := resolveGateway()
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no default gateway found")
+	}
+	if err != nil {
+		return nil, &WstunnelHostError{Entry: entry, Host: entry, Err: fmt.Errorf("unable to look up the default gateway: %w", err)}
+	}
+	prefixes := make([]netip.Prefix, 0, len(addrs))
+	for _, addr := range addrs {
+		prefixes = append(prefixes, prefixFromAddr(addr.Unmap()))
+	}
+	return prefixes, nil
+}
+
+// wstunnelHostEndpointsKey is the context key under which parsing finds the
+// peers that @endpoint entries refer to.
+type wstunnelHostEndpointsKey struct{}
+
+// wstunnelHostSkipEndpointsKey is the context key that, when set, makes
+// @endpoint entries resolve to nothing, for checking a value without a config.
+type wstunnelHostSkipEndpointsKey struct{}
+
+// wstunnelHostEndpointPeer returns the 1-based peer number of an @endpoint:N
+// entry, or 1 for a bare @endpoint.
+func wstunnelHostEndpointPeer(part string) (int, bool, error) {
+	rest, ok := strings.CutPrefix(part, "@endpoint")
+	if !ok {
+		return 0, false, nil
+	}
+	if len(rest) == 0 {
+		return 1, true, nil
+	}
+	n, ok := strings.CutPrefix(rest, ":")
+	if !ok {
+		return 0, false, nil
+	}
+	peer, err := strconv.ParseUint(n, 10, 16)
+	if err != nil || peer == 0 {
+		return 0, true, fmt.Errorf("invalid WSTUNNEL_HOST peer number %q in %s", n, part)
+	}
+	return int(peer), true, nil
+}
+
+func resolveWstunnelHostEndpoint(ctx context.Context, entry string, peer int) ([]netip.Prefix, error) {
+	if ctx.Value(wstunnelHostSkipEndpointsKey{}) != nil {
+		return nil, nil
+	}
+	peers, _ := ctx.Value(wstunnelHostEndpointsKey{}).([]Peer)
+	if peer > len(peers) {
+		return nil, fmt.Errorf("WSTUNNEL_HOST %s refers to peer %d, but there are only %d peers", entry, peer, len(peers))
+	}
+	endpoint := &peers[peer-1].Endpoint
+	if endpoint.IsEmpty() {
+		return nil, fmt.Errorf("WSTUNNEL_HOST %s refers to peer %d, which has no endpoint", entry, peer)
+	}
+	return resolveWstunnelHostEntry(ctx, entry, endpoint.Host)
+}
+
+// wstunnelHostNamedSet returns the name of an asn:NAME entry. As with env:,
+// a numeric name, as in asn:443, is a port instead.
+func wstunnelHostNamedSet(part string) (string, bool) {
+	name, ok := strings.CutPrefix(part, "asn:")
+	if !ok || len(strings.Trim(name, "0123456789")) == 0 {
+		return "", false
+	}
+	return name, true
+}
+
+// wstunnelHostRange returns the bounds of a START-END entry, reporting
+// whether part is one. Hostnames may contain dashes too, so both sides must be
+// addresses; they must then be of the same family and in order.
+func wstunnelHostRange(part string) (from, to netip.Addr, ok bool, err error) {
+	first, last, found := strings.Cut(part, "-")
+	if !found {
+		return
+	}
+	from, fromErr := netip.ParseAddr(strings.TrimSpace(first))
+	to, toErr := netip.ParseAddr(strings.TrimSpace(last))
+	if fromErr != nil || toErr != nil {
+		return netip.Addr{}, netip.Addr{}, false, nil
+	}
+	from, to = from.Unmap(), to.Unmap()
+	switch {
+	case from.Zone() != "" || to.Zone() != "":
+		err = fmt.Errorf("invalid WSTUNNEL_HOST range %q: zones are not allowed", part)
+	case from.Is4() != to.Is4():
+		err = fmt.Errorf("invalid WSTUNNEL_HOST range %q: both ends must be of the same address family", part)
+	case to.Less(from):
+		err = fmt.Errorf("invalid WSTUNNEL_HOST range %q: start is after end", part)
+	}
+	return from, to, true, err
+}
+
+// rangeToPrefixes returns the fewest prefixes covering exactly from to to,
+// taking at each step the largest aligned prefix that starts at from and does
+// not go past to.
+func rangeToPrefixes(from, to netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		bits := from.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(from, bits-1).Masked()
+			if wider.Addr() != from || to.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		prefixes = append(prefixes, p)
+		last := lastAddr(p)
+		if last == to {
+			return prefixes
+		}
+		from = last.Next()
+	}
+}
+
+// wstunnelHostAutoSubnet returns the host of an auto-subnet:HOST entry. As
+// with asn:, a number after the colon is a port instead.
+func wstunnelHostAutoSubnet(part string) (string, bool) {
+	host, ok := strings.CutPrefix(part, "auto-subnet:")
+	if !ok || len(strings.Trim(host, "0123456789")) == 0 {
+		return "", false
+	}
+	return host, true
+}
+
+// wstunnelHostsAlias returns the alias of a hosts:ALIAS entry. As with asn:,
+// a number after the colon is a port instead.
+func wstunnelHostsAlias(part string) (string, bool) {
+	alias, ok := strings.CutPrefix(part, "hosts:")
+	if !ok || len(strings.Trim(alias, "0123456789")) == 0 {
+		return "", false
+	}
+	return alias, true
+}
+
+// validateWstunnelHostsAlias checks that alias is a plain hostname, as it
+// would appear in a hosts file.
+func validateWstunnelHostsAlias(alias string) error {
+	if _, err := netip.ParseAddr(alias); err == nil || strings.ContainsAny(alias, " \t/:@{}") {
+		return fmt.Errorf("invalid WSTUNNEL_HOST hosts:%s: expected a hostname", alias)
+	}
+	return nil
+}
+
+// resolveWstunnelHostsAlias looks up the addresses the hosts file maps alias
+// to. This does not depend on DNS, so it keeps working where DNS is blocked
+// but the hosts file pins the wstunnel server.
+func resolveWstunnelHostsAlias(entry, alias string) ([]netip.Prefix, error) {
+	data, err := readHostsFile()
+	if err != nil {
+		return nil, &WstunnelHostError{Entry: entry, Host: entry, Err: fmt.Errorf("unable to read the hosts file for WSTUNNEL_HOST %s: %w", entry, err)}
+	}
+	addrs := parseHostsFile(data, alias)
+	if len(addrs) == 0 {
+		return nil, &WstunnelHostError{Entry: entry, Host: entry, Err: fmt.Errorf("the hosts file has no entry for WSTUNNEL_HOST %s", entry)}
+	}
+	prefixes := make([]netip.Prefix, 0, len(addrs))
+	for _, addr := range addrs {
+		prefixes = append(prefixes, prefixFromAddr(addr))
+	}
+	if err := verifyResolvedHost(alias, prefixes); err != nil {
+		return nil, &WstunnelHostError{Entry: entry, Host: entry, Err: err}
+	}
+	return prefixes, nil
+}
+
+// parseHostsFile returns, in file order and without duplicates, the
+// addresses that the hosts file data maps name to, ignoring case and a
+// trailing dot.
+func parseHostsFile(data []byte, name string) []netip.Addr {
+	name = normalizeHostname(name)
+	var addrs []netip.Addr
+	seen := make(map[netip.Addr]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap().WithZone("")
+		for _, field := range fields[1:] {
+			if strings.EqualFold(normalizeHostname(field), name) && !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// resolveWstunnelHostAutoSubnet resolves host and widens each of its
+// addresses to the on-link prefix containing it.
+func resolveWstunnelHostAutoSubnet(ctx context.Context, entry string, host *wstunnelHostEntry) ([]netip.Prefix, error) {
+	addrs, err := host.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]netip.Prefix, 0, len(addrs))
+	for _, p := range addrs {
+		onLink, err := resolveOnLinkPrefix(p.Addr())
+		if err == nil && !onLink.Contains(p.Addr()) {
+			err = fmt.Errorf("%s is not within it", p.Addr())
+		}
+		if err != nil {
+			return nil, &WstunnelHostError{Entry: entry, Host: entry, Err: fmt.Errorf("unable to look up the on-link prefix of %s: %w", p.Addr(), err)}
+		}
+		prefixes = append(prefixes, unmapPrefix(onLink.Masked()))
+	}
+	return prefixes, nil
+}
+
+func resolveWstunnelHostNamedSet(entry, name string) ([]netip.Prefix, error) {
+	if resolveNamedPrefixSet == nil {
+		return nil, fmt.Errorf("no resolver is set for WSTUNNEL_HOST prefix set %q", name)
+	}
+	prefixes, err := resolveNamedPrefixSet(name)
 	if err != nil {
-		return err
+		return nil, &WstunnelHostError{Entry: entry, Host: entry, Err: fmt.Errorf("unable to look up WSTUNNEL_HOST prefix set %q: %w", name, err)}
 	}
-	if len(excludes) == 0 {
-		return nil
+	out := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			return nil, fmt.Errorf("WSTUNNEL_HOST prefix set %q contains an invalid prefix", name)
+		}
+		out = append(out, unmapPrefix(p))
 	}
-	log.Printf("WSTUNNEL_HOST excludes: %s", prefixListToString(excludes))
+	return out, nil
+}
 
-	for i := range config.Peers {
-		if len(config.Peers[i].AllowedIPs) == 0 {
+// wstunnelHostEnvName returns the variable name of an env:NAME entry. Only
+// names that are valid identifiers count, so that a host called env with a
+// port, like env:443, is still taken literally.
+func wstunnelHostEnvName(part string) (string, bool) {
+	name, ok := strings.CutPrefix(part, "env:")
+	if !ok || len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		return "", false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_') {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// expandWstunnelHostEnv returns the single WSTUNNEL_HOST entry held by the
+// environment variable name.
+func expandWstunnelHostEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s referenced by WSTUNNEL_HOST is not set", name)
+	}
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return "", fmt.Errorf("environment variable %s referenced by WSTUNNEL_HOST is empty", name)
+	}
+	if strings.ContainsRune(value, ',') || strings.HasPrefix(value, "@") || strings.HasPrefix(value, "!") {
+		return "", fmt.Errorf("environment variable %s referenced by WSTUNNEL_HOST must hold a single host, address or prefix", name)
+	}
+	if _, ok := wstunnelHostEnvName(value); ok {
+		return "", fmt.Errorf("environment variable %s referenced by WSTUNNEL_HOST refers to another variable", name)
+	}
+	return value, nil
+}
+
+// parseWstunnelHostFile reads one WSTUNNEL_HOST entry per line from path,
+// skipping blank lines and lines starting with #. Entries that fail to parse
+// are reported by line number while the rest are still returned.
+func parseWstunnelHostFile(ctx context.Context, path string) ([]netip.Prefix, error) {
+	if len(path) == 0 {
+		return nil, errors.New("missing WSTUNNEL_HOST file name after @")
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("WSTUNNEL_HOST file %q does not exist", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read WSTUNNEL_HOST file %q: %w", path, err)
+	}
+	var excludes []netip.Prefix
+	var errs []error
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
-		before := prefixListToString(config.Peers[i].AllowedIPs)
-		config.Peers[i].AllowedIPs = subtractPrefixList(config.Peers[i].AllowedIPs, excludes)
-		after := prefixListToString(config.Peers[i].AllowedIPs)
-		if before != after {
-			log.Printf("AllowedIPs updated for peer %d: %s -> %s", i+1, before, after)
+		entry, err := parseWstunnelHostEntry(line)
+		if err == nil && entry.form == formFile {
+			err = &WstunnelHostError{Entry: line, Err: errors.New("WSTUNNEL_HOST files cannot include other files")}
+		}
+		var prefixes []netip.Prefix
+		if err == nil {
+			prefixes, err = entry.resolve(ctx)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", path, i+1, classifyWstunnelHostError(line, err)))
+			continue
 		}
+		excludes = append(excludes, prefixes...)
 	}
-	return nil
+	return excludes, errors.Join(errs...)
 }
 
-func parseWstunnelHostExcludes(s string) ([]netip.Prefix, error) {
-	parts, err := splitCommaList(s)
+// resolveWstunnelHostMasked resolves host and masks each of its addresses to
+// bits.
+func resolveWstunnelHostMasked(ctx context.Context, part, host string, bits int) ([]netip.Prefix, error) {
+	resolved, err := resolveWstunnelHostEntry(ctx, part, host)
 	if err != nil {
 		return nil, err
 	}
-	excludes := make([]netip.Prefix, 0, len(parts))
-	for _, part := range parts {
-		if strings.Contains(part, "/") {
-			p, err := netip.ParsePrefix(part)
-			if err != nil {
-				return nil, fmt.Errorf("invalid WSTUNNEL_HOST prefix %q: %w", part, err)
-			}
-			excludes = append(excludes, p.Masked())
+	prefixes := make([]netip.Prefix, 0, len(resolved))
+	for _, p := range resolved {
+		if bits > p.Addr().BitLen() {
+			return nil, fmt.Errorf("invalid WSTUNNEL_HOST mask /%d for %s address %s", bits, host, p.Addr())
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(p.Addr(), bits).Masked())
+	}
+	return prefixes, nil
+}
+
+// resolveWstunnelHostEntry resolves the host of a WSTUNNEL_HOST entry, counting
+// the outcome in the stats returned by WstunnelStats.
+func resolveWstunnelHostEntry(ctx context.Context, entry, host string) ([]netip.Prefix, error) {
+	host = normalizeHostname(host)
+	prefixes, err := resolveExcludeHost(ctx, host)
+	_, literalErr := netip.ParseAddr(host)
+	if literalErr != nil {
+		if err != nil {
+			wstunnelStats.resolutionFailures.Add(1)
+		} else {
+			wstunnelStats.resolutionSuccesses.Add(1)
+		}
+	}
+	if err != nil {
+		return nil, &WstunnelHostError{Entry: entry, Host: host, Err: fmt.Errorf("failed to resolve WSTUNNEL_HOST %q: %w", host, err)}
+	}
+	if err := verifyResolvedHost(host, prefixes); err != nil {
+		return nil, &WstunnelHostError{Entry: entry, Host: host, Err: err}
+	}
+	if CompactWstunnelHostExcludes && literalErr != nil && len(prefixes) > 1 {
+		addrs := make([]netip.Addr, 0, len(prefixes))
+		for _, p := range prefixes {
+			addrs = append(addrs, p.Addr())
+		}
+		prefixes = minimalCover(addrs)
+	}
+	return prefixes, nil
+}
+
+// minimalCover returns, per address family, the smallest prefix that covers
+// all of addrs, or a single-address prefix for each of them if that would be
+// shorter than a /24 or, for IPv6, a /64.
+func minimalCover(addrs []netip.Addr) []netip.Prefix {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap().WithZone("")
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else if addr.IsValid() {
+			v6 = append(v6, addr)
+		}
+	}
+	var out []netip.Prefix
+	for _, family := range []struct {
+		addrs   []netip.Addr
+		minBits int
+	}{{v4, 24}, {v6, 64}} {
+		if len(family.addrs) == 0 {
 			continue
 		}
-		if addr, err := netip.ParseAddr(part); err == nil {
-			excludes = append(excludes, prefixFromAddr(addr))
+		if cover, ok := coveringPrefix(family.addrs, family.minBits); ok {
+			out = append(out, cover)
 			continue
 		}
-		resolved, err := resolveHostname(part)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve WSTUNNEL_HOST %q: %w", part, err)
+		for _, addr := range family.addrs {
+			out = append(out, prefixFromAddr(addr))
 		}
-		addr, err := netip.ParseAddr(resolved)
-		if err != nil {
-			return nil, fmt.Errorf("invalid resolved WSTUNNEL_HOST %q: %w", part, err)
+	}
+	sortPrefixes(out)
+	return dedupeSortedPrefixes(out)
+}
+
+// coveringPrefix returns the longest prefix of at least minBits that contains
+// every address in addrs, which must all be of the same family.
+func coveringPrefix(addrs []netip.Addr, minBits int) (netip.Prefix, bool) {
+	for bits := addrs[0].BitLen(); bits >= minBits; bits-- {
+		cover := netip.PrefixFrom(addrs[0], bits).Masked()
+		covered := true
+		for _, addr := range addrs[1:] {
+			if !cover.Contains(addr) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return cover, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func verifyResolvedHost(host string, resolved []netip.Prefix) error {
+	if VerifyResolvedHost == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	for _, p := range resolved {
+		if err := VerifyResolvedHost(host, p.Addr()); err != nil {
+			return fmt.Errorf("WSTUNNEL_HOST %q resolved to %s, which failed verification: %w", host, p.Addr(), err)
+		}
+	}
+	return nil
+}
+
+func resolveExcludeHost(ctx context.Context, host string) ([]netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Prefix{prefixFromAddr(addr.Unmap())}, nil
+	}
+	ctx = withAttemptTimeout(ctx, WstunnelHostResolveTimeout)
+	resolver := wstunnelHostResolver()
+	resolved, err := wstunnelHostCache.resolve(normalizeHostname(host), func(name string) ([]netip.Addr, error) {
+		return resolver(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]netip.Prefix, 0, len(resolved))
+	for _, addr := range resolved {
+		prefixes = append(prefixes, prefixFromAddr(addr.Unmap()))
+	}
+	return prefixes, nil
+}
+
+// normalizeHostname strips the trailing dot of a fully qualified name, so that
+// host and host. resolve, are cached and are logged the same way.
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(host, ".")
+}
+
+// ValidateWstunnelHost is ValidateWstunnelHostSyntax.
+func ValidateWstunnelHost(s string) error {
+	return ValidateWstunnelHostSyntax(s)
+}
+
+// ValidateWstunnelHostSyntax checks the syntax of a WSTUNNEL_HOST value
+// without resolving hostnames, reading files or expanding env:NAME entries,
+// and returns the first problem found.
+func ValidateWstunnelHostSyntax(s string) error {
+	_, err := ParseWstunnelHostSpec(s)
+	return err
+}
+
+// ValidateWstunnelHostResolvable checks the syntax of a WSTUNNEL_HOST value
+// and then resolves every hostname in it, including those in @file entries,
+// returning an error for each entry that did not resolve. @endpoint entries,
+// including those on the lines of @file entries, depend on the peers, so they
+// are only checked for syntax.
+func ValidateWstunnelHostResolvable(ctx context.Context, s string) error {
+	spec, err := ParseWstunnelHostSpec(s)
+	if err != nil {
+		return err
+	}
+	entryErrs, err := spec.resolve(context.WithValue(ctx, wstunnelHostSkipEndpointsKey{}, true))
+	if err != nil {
+		return err
+	}
+	return errors.Join(entryErrs...)
+}
+
+// validateWstunnelHostname checks that host is made of valid DNS labels and
+// is not something like a truncated IPv4 address.
+func validateWstunnelHostname(host string) error {
+	name := strings.TrimSuffix(host, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("invalid WSTUNNEL_HOST hostname %q", host)
+	}
+	allNumeric := true
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid WSTUNNEL_HOST hostname %q", host)
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c >= '0' && c <= '9':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-', c == '_':
+				allNumeric = false
+			default:
+				return fmt.Errorf("invalid WSTUNNEL_HOST hostname %q", host)
+			}
+		}
+	}
+	if allNumeric {
+		return fmt.Errorf("invalid WSTUNNEL_HOST hostname %q", host)
+	}
+	return nil
+}
+
+// wstunnelHostPort checks the syntax of a WSTUNNEL_HOST value and returns the
+// port of its first host that has one, other than those kept with !.
+func wstunnelHostPort(s string) (uint16, error) {
+	spec, err := ParseWstunnelHostSpec(s)
+	if err != nil {
+		return 0, err
+	}
+	for i := range spec.Entries {
+		if entry := &spec.Entries[i]; !entry.Keep {
+			if port := entry.parsed.hostPort(); port != 0 {
+				return port, nil
+			}
 		}
-		excludes = append(excludes, prefixFromAddr(addr))
 	}
-	return excludes, nil
+	return 0, nil
+}
+
+func splitWstunnelHost(s string) (string, uint16, error) {
+	if strings.Contains(s, "://") {
+		return parseWstunnelHostURL(s)
+	}
+	return splitWstunnelHostPort(s)
+}
+
+func parseWstunnelHostURL(s string) (string, uint16, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid WSTUNNEL_HOST URL %q: %w", s, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ws", "wss", "http", "https":
+	default:
+		return "", 0, fmt.Errorf("unsupported WSTUNNEL_HOST URL scheme %q in %q", u.Scheme, s)
+	}
+	host := u.Hostname()
+	if len(host) == 0 {
+		return "", 0, fmt.Errorf("WSTUNNEL_HOST URL %q has no host", s)
+	}
+	port, err := parseWstunnelPort(s, u.Port())
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func splitWstunnelHostPort(s string) (string, uint16, error) {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1], 0, nil
+	}
+	if !strings.HasPrefix(s, "[") && strings.Count(s, ":") != 1 {
+		return s, 0, nil
+	}
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid WSTUNNEL_HOST %q: %w", s, err)
+	}
+	port, err := parseWstunnelPort(s, portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func parseWstunnelPort(s, port string) (uint16, error) {
+	if len(port) == 0 {
+		return 0, nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WSTUNNEL_HOST port in %q", s)
+	}
+	return uint16(p), nil
 }
 
 func splitCommaList(s string) ([]string, error) {
@@ -77,31 +2086,140 @@ func splitCommaList(s string) ([]string, error) {
 	for _, split := range strings.Split(s, ",") {
 		trim := strings.TrimSpace(split)
 		if len(trim) == 0 {
-			return nil, fmt.Errorf("invalid list entry in %q", s)
+			continue
 		}
 		out = append(out, trim)
 	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty list in %q", s)
+	}
 	return out, nil
 }
 
 func prefixFromAddr(addr netip.Addr) netip.Prefix {
+	addr = addr.WithZone("")
 	if addr.Is4() {
 		return netip.PrefixFrom(addr, 32)
 	}
 	return netip.PrefixFrom(addr, 128)
 }
 
-func subtractPrefixList(base []netip.Prefix, remove []netip.Prefix) []netip.Prefix {
+// subtractPrefixList removes every prefix in remove from base. IPv4-mapped
+// IPv6 prefixes in either list are unmapped first, so the result contains
+// them in their native IPv4 form.
+func subtractPrefixList(base []netip.Prefix, remove []netip.Prefix) ([]netip.Prefix, error) {
+	if err := validatePrefixList(base); err != nil {
+		return nil, err
+	}
+	if err := validatePrefixList(remove); err != nil {
+		return nil, err
+	}
+	// Overlapping AllowedIPs would otherwise leave overlapping fragments.
+	base4, base6 := partitionPrefixes(unionPrefixList(unmapPrefixList(base), nil))
+	remove4, remove6 := partitionPrefixes(unmapPrefixList(remove))
+	out := append(subtractSameFamily(base4, remove4), subtractSameFamily(base6, remove6)...)
+	out = coalescePrefixes(out)
+	sortPrefixes(out)
+	out = dedupeSortedPrefixes(out)
+	if VerifyPrefixSubtraction {
+		if err := verifySubtraction(base, remove, out); err != nil {
+			return nil, fmt.Errorf("prefix subtraction is wrong: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// SubtractPrefixes returns the addresses of base that are not in remove, as
+// sorted, disjoint prefixes with adjacent siblings merged. Prefixes are masked
+// and IPv4-mapped IPv6 prefixes are treated as IPv4, and each family is only
+// subtracted from itself, so removing ::/0 leaves IPv4 prefixes alone. An
+// invalid prefix in either list is an error.
+func SubtractPrefixes(base, remove []netip.Prefix) ([]netip.Prefix, error) {
+	return subtractPrefixList(base, remove)
+}
+
+// CoalescePrefixes returns the addresses of prefixes as sorted, disjoint
+// prefixes, dropping those covered by others and merging adjacent siblings.
+// Prefixes are masked and IPv4-mapped IPv6 prefixes are treated as IPv4.
+func CoalescePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	return unionPrefixList(unmapPrefixList(prefixes), nil)
+}
+
+// IntersectPrefixes returns the addresses that are in both a and b, in the
+// same form as CoalescePrefixes.
+func IntersectPrefixes(a, b []netip.Prefix) []netip.Prefix {
+	return intersectPrefixList(unmapPrefixList(a), unmapPrefixList(b))
+}
+
+// verifySubtraction checks that result is made of disjoint prefixes covering
+// exactly the addresses of base that are not in remove.
+func verifySubtraction(base, remove, result []netip.Prefix) error {
+	base = unionPrefixList(unmapPrefixList(base), nil)
+	remove = unionPrefixList(unmapPrefixList(remove), nil)
+	result = unmapPrefixList(result)
+	sortPrefixes(result)
+	// Sorted by start address, any prefix overlapping a later one also
+	// overlaps the one right after it.
+	for i := 1; i < len(result); i++ {
+		if result[i-1].Addr().Is4() == result[i].Addr().Is4() && result[i-1].Overlaps(result[i]) {
+			return fmt.Errorf("%s overlaps %s", result[i-1], result[i])
+		}
+	}
+	for _, r := range result {
+		if excluded := intersectPrefixList([]netip.Prefix{r}, remove); len(excluded) > 0 {
+			return fmt.Errorf("%s includes removed %s", r, prefixListToString(excluded))
+		}
+		if prefixListAddressCount(intersectPrefixList([]netip.Prefix{r}, base)).Cmp(prefixListAddressCount([]netip.Prefix{r})) != 0 {
+			return fmt.Errorf("%s is not within %s", r, prefixListToString(base))
+		}
+	}
+	want := prefixListAddressCount(base)
+	want.Sub(want, prefixListAddressCount(intersectPrefixList(base, remove)))
+	if got := prefixListAddressCount(result); got.Cmp(want) != 0 {
+		return fmt.Errorf("%s covers %s addresses rather than %s", prefixListToString(result), got, want)
+	}
+	return nil
+}
+
+// partitionPrefixes splits prefixes into their IPv4 and IPv6 members,
+// preserving order.
+func partitionPrefixes(prefixes []netip.Prefix) (v4, v6 []netip.Prefix) {
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	return v4, v6
+}
+
+// subtractSameFamily is subtractPrefixList for masked prefixes that all
+// belong to one address family. The result is neither coalesced nor sorted.
+func subtractSameFamily(base []netip.Prefix, remove []netip.Prefix) []netip.Prefix {
+	// Sorted, disjoint excludes let each base find the few it overlaps with
+	// a binary search, rather than checking every exclude.
+	remove = unionPrefixList(remove, nil)
 	out := make([]netip.Prefix, 0, len(base))
 	for _, b := range base {
-		fragments := []netip.Prefix{b.Masked()}
-		for _, r := range remove {
-			if b.Addr().Is4() != r.Addr().Is4() {
+		last := lastAddr(b)
+		first := sort.Search(len(remove), func(i int) bool {
+			return !lastAddr(remove[i]).Less(b.Addr())
+		})
+		fragments := []netip.Prefix{b}
+		for _, r := range remove[first:] {
+			if last.Less(r.Addr()) {
+				break
+			}
+			// Excludes are mostly single hosts, which can only split the one
+			// fragment that contains them, so the rest are left in place.
+			if r.IsSingleIP() {
+				fragments = subtractAddrFromSorted(fragments, r.Addr())
 				continue
 			}
 			newFragments := make([]netip.Prefix, 0, len(fragments))
 			for _, f := range fragments {
-				newFragments = append(newFragments, subtractPrefix(f, r.Masked())...)
+				newFragments = append(newFragments, subtractPrefix(f, r)...)
 			}
 			fragments = newFragments
 		}
@@ -110,27 +2228,237 @@ func subtractPrefixList(base []netip.Prefix, remove []netip.Prefix) []netip.Pref
 	return out
 }
 
+func unmapPrefixList(prefixes []netip.Prefix) []netip.Prefix {
+	out := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		out[i] = unmapPrefix(p)
+	}
+	return out
+}
+
+func unmapPrefix(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96).Masked()
+	}
+	return p.Masked()
+}
+
+func validatePrefixList(prefixes []netip.Prefix) error {
+	for _, p := range prefixes {
+		if !p.IsValid() || p.Bits() > maxPrefixBits(p) {
+			return fmt.Errorf("invalid prefix %s/%d", p.Addr(), p.Bits())
+		}
+	}
+	return nil
+}
+
+func intersectPrefixList(a []netip.Prefix, b []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, x := range a {
+		for _, y := range b {
+			if x.Addr().Is4() != y.Addr().Is4() || !x.Overlaps(y) {
+				continue
+			}
+			if x.Bits() >= y.Bits() {
+				out = append(out, x.Masked())
+			} else {
+				out = append(out, y.Masked())
+			}
+		}
+	}
+	return unionPrefixList(out, nil)
+}
+
+func sortPrefixes(prefixes []netip.Prefix) {
+	less := func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	}
+	// AllowedIPs are usually written in order already.
+	if !sort.SliceIsSorted(prefixes, less) {
+		sort.Slice(prefixes, less)
+	}
+}
+
+// dedupePrefixes removes repeated prefixes in place, comparing them masked,
+// and keeps the first of each.
+func dedupePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	seen := make(map[netip.Prefix]bool, len(prefixes))
+	out := prefixes[:0]
+	for _, p := range prefixes {
+		if seen[p.Masked()] {
+			continue
+		}
+		seen[p.Masked()] = true
+		out = append(out, p)
+	}
+	return out
+}
+
+func dedupeSortedPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	if len(prefixes) == 0 {
+		return prefixes
+	}
+	i := 1
+	for _, p := range prefixes[1:] {
+		if p == prefixes[i-1] {
+			continue
+		}
+		prefixes[i] = p
+		i++
+	}
+	return prefixes[:i]
+}
+
+func coalescePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	for {
+		present := make(map[netip.Prefix]bool, len(prefixes))
+		for _, p := range prefixes {
+			present[p] = true
+		}
+		merged := false
+		out := make([]netip.Prefix, 0, len(prefixes))
+		for _, p := range prefixes {
+			if !present[p] {
+				continue
+			}
+			if p.Bits() == 0 {
+				out = append(out, p)
+				continue
+			}
+			sibling := siblingPrefix(p)
+			if present[sibling] {
+				delete(present, sibling)
+				out = append(out, netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked())
+				merged = true
+			} else {
+				out = append(out, p)
+			}
+			delete(present, p)
+		}
+		prefixes = out
+		if !merged {
+			return prefixes
+		}
+	}
+}
+
+func siblingPrefix(p netip.Prefix) netip.Prefix {
+	left, right, _ := splitPrefix(netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked())
+	if left == p {
+		return right
+	}
+	return left
+}
+
+func unionPrefixList(base []netip.Prefix, add []netip.Prefix) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(base)+len(add))
+	for _, p := range base {
+		out = append(out, p.Masked())
+	}
+	for _, p := range add {
+		out = append(out, p.Masked())
+	}
+	sortPrefixes(out)
+	out = removeCoveredSortedPrefixes(out)
+	out = coalescePrefixes(out)
+	sortPrefixes(out)
+	return dedupeSortedPrefixes(out)
+}
+
+func removeCoveredSortedPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	out := prefixes[:0]
+	for _, p := range prefixes {
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			if last.Bits() <= p.Bits() && last.Contains(p.Addr()) {
+				continue
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
 func subtractPrefix(base, remove netip.Prefix) []netip.Prefix {
+	return subtractPrefixDepth(base, remove, 0)
+}
+
+// subtractPrefixDepth is subtractPrefix at the given recursion depth. Each
+// level splits base in two, so depth cannot exceed the bit length of the
+// address family unless the splitting is broken, in which case base is
+// returned unchanged rather than recursing further.
+func subtractPrefixDepth(base, remove netip.Prefix, depth int) []netip.Prefix {
+	if depth > base.Addr().BitLen() {
+		Logger("Internal error: subtracting %s from %s recursed %d levels deep", remove, base, depth)
+		return []netip.Prefix{base}
+	}
 	base = base.Masked()
 	remove = remove.Masked()
 	if !base.Overlaps(remove) {
 		return []netip.Prefix{base}
 	}
-	if remove.Contains(base.Addr()) && remove.Bits() <= base.Bits() {
+	// Overlapping prefixes are always nested, so either remove covers all of
+	// base, or remove is strictly longer and lies within exactly one child.
+	if remove.Bits() <= base.Bits() {
 		return nil
 	}
-	if base.Bits() >= maxPrefixBits(base) {
+	left, right, ok := splitPrefix(base)
+	if !ok {
 		return []netip.Prefix{base}
 	}
-	left, right := splitPrefix(base)
-	if remove.Overlaps(left) {
-		return append(subtractPrefix(left, remove), right)
+	switch overlapsLeft, overlapsRight := remove.Overlaps(left), remove.Overlaps(right); {
+	case overlapsLeft && overlapsRight:
+		// Unreachable given the check above, but keeping right here would
+		// leave addresses of remove behind.
+		return nil
+	case overlapsLeft:
+		return append(subtractPrefixDepth(left, remove, depth+1), right)
+	default:
+		return append([]netip.Prefix{left}, subtractPrefixDepth(right, remove, depth+1)...)
+	}
+}
+
+// subtractAddrFromSorted removes addr from sorted, disjoint fragments in
+// place, replacing the one fragment that contains it, if any, with what is
+// left of it.
+func subtractAddrFromSorted(fragments []netip.Prefix, addr netip.Addr) []netip.Prefix {
+	i := sort.Search(len(fragments), func(i int) bool {
+		return !lastAddr(fragments[i]).Less(addr)
+	})
+	if i == len(fragments) || !fragments[i].Contains(addr) {
+		return fragments
+	}
+	split := subtractAddr(fragments[i], addr)
+	sortPrefixes(split)
+	if len(split) == 0 {
+		return append(fragments[:i], fragments[i+1:]...)
+	}
+	tail := len(fragments) - i - 1
+	fragments = append(fragments, split[1:]...)
+	copy(fragments[i+len(split):], fragments[i+1:i+1+tail])
+	copy(fragments[i:], split)
+	return fragments
+}
+
+// subtractAddr is subtractPrefix for a single address within base, and
+// returns the siblings along the path from base down to addr.
+func subtractAddr(base netip.Prefix, addr netip.Addr) []netip.Prefix {
+	base = base.Masked()
+	out := make([]netip.Prefix, 0, addr.BitLen()-base.Bits())
+	for bits := base.Bits() + 1; bits <= addr.BitLen(); bits++ {
+		out = append(out, siblingPrefix(netip.PrefixFrom(addr, bits).Masked()))
 	}
-	return append([]netip.Prefix{left}, subtractPrefix(right, remove)...)
+	return out
 }
 
-func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+func splitPrefix(p netip.Prefix) (left, right netip.Prefix, ok bool) {
 	bits := p.Bits()
+	if bits < 0 || bits >= maxPrefixBits(p) {
+		return p, p, false
+	}
 	if p.Addr().Is4() {
 		addr := p.Addr().As4()
 		v := binary.BigEndian.Uint32(addr[:])
@@ -138,11 +2466,33 @@ func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
 		right := v | bit
 		var rightAddr [4]byte
 		binary.BigEndian.PutUint32(rightAddr[:], right)
-		return netip.PrefixFrom(p.Addr(), bits+1), netip.PrefixFrom(netip.AddrFrom4(rightAddr), bits+1)
+		return netip.PrefixFrom(p.Addr(), bits+1), netip.PrefixFrom(netip.AddrFrom4(rightAddr), bits+1), true
 	}
 	addr := p.Addr().As16()
 	setBit128(&addr, bits)
-	return netip.PrefixFrom(p.Addr(), bits+1), netip.PrefixFrom(netip.AddrFrom16(addr), bits+1)
+	return netip.PrefixFrom(p.Addr(), bits+1), netip.PrefixFrom(netip.AddrFrom16(addr), bits+1), true
+}
+
+// lastAddr returns the highest address within p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		addr := p.Addr().As4()
+		v := binary.BigEndian.Uint32(addr[:]) | ^uint32(0)>>uint(bits)
+		binary.BigEndian.PutUint32(addr[:], v)
+		return netip.AddrFrom4(addr)
+	}
+	addr := p.Addr().As16()
+	hi, lo := binary.BigEndian.Uint64(addr[:8]), binary.BigEndian.Uint64(addr[8:])
+	if bits < 64 {
+		hi |= ^uint64(0) >> uint(bits)
+		lo = ^uint64(0)
+	} else {
+		lo |= ^uint64(0) >> uint(bits-64)
+	}
+	binary.BigEndian.PutUint64(addr[:8], hi)
+	binary.BigEndian.PutUint64(addr[8:], lo)
+	return netip.AddrFrom16(addr)
 }
 
 func setBit128(addr *[16]byte, bit int) {
@@ -158,6 +2508,35 @@ func maxPrefixBits(p netip.Prefix) int {
 	return 128
 }
 
+func addressesRemoved(before, after []netip.Prefix) *big.Int {
+	removed := prefixListAddressCount(unionPrefixList(unmapPrefixList(before), nil))
+	return removed.Sub(removed, prefixListAddressCount(unionPrefixList(after, nil)))
+}
+
+// prefixListAddressCount returns the number of addresses covered by prefixes, which
+// must not overlap.
+func prefixListAddressCount(prefixes []netip.Prefix) *big.Int {
+	size := new(big.Int)
+	one := big.NewInt(1)
+	for _, p := range prefixes {
+		size.Add(size, new(big.Int).Lsh(one, uint(maxPrefixBits(p)-p.Bits())))
+	}
+	return size
+}
+
+// FormatAddressCount renders an address count exactly when it is small, and
+// as a power of two or in scientific notation when it is not.
+func FormatAddressCount(count *big.Int) string {
+	if count.BitLen() <= 48 {
+		return count.String()
+	}
+	bits := count.BitLen() - 1
+	if count.TrailingZeroBits() == uint(bits) {
+		return fmt.Sprintf("2^%d", bits)
+	}
+	return new(big.Float).SetInt(count).Text('e', 2)
+}
+
 func prefixListToString(prefixes []netip.Prefix) string {
 	if len(prefixes) == 0 {
 		return ""
@@ -168,3 +2547,29 @@ func prefixListToString(prefixes []netip.Prefix) string {
 	}
 	return strings.Join(parts, ", ")
 }
+
+// formatExclusionReport formats the changed peers of diffs for the event log,
+// which shows long lines poorly: a header with the addresses the excludes
+// removed, then for each peer its original AllowedIPs with the result
+// indented below.
+func formatExclusionReport(diffs []PeerAllowedIPsDiff) string {
+	var removed []netip.Prefix
+	var b strings.Builder
+	for _, diff := range diffs {
+		before, after := prefixListToString(diff.Before), prefixListToString(diff.After)
+		if before == after {
+			continue
+		}
+		if gone, err := subtractPrefixList(diff.Before, diff.After); err == nil {
+			removed = append(removed, gone...)
+		}
+		if after == "" {
+			after = "(none)"
+		}
+		fmt.Fprintf(&b, "\nPeer %d: %s\n    %s", diff.Peer+1, before, after)
+	}
+	if b.Len() == 0 {
+		return "WSTUNNEL_HOST excludes changed no AllowedIPs"
+	}
+	return "WSTUNNEL_HOST excludes " + prefixListToString(unionPrefixList(removed, nil)) + b.String()
+}
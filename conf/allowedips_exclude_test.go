@@ -0,0 +1,2197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func parsePrefixes(t testing.TB, s ...string) []netip.Prefix {
+	t.Helper()
+	out := make([]netip.Prefix, len(s))
+	for i := range s {
+		p, err := netip.ParsePrefix(s[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = p
+	}
+	return out
+}
+
+var errFakeNoSuchHost = errors.New("no such host")
+
+// fakeResolver replaces resolveHostnameFunc for the duration of the test with
+// one that answers from hosts and fails with errFakeNoSuchHost otherwise.
+func fakeResolver(t *testing.T, hosts map[string][]string) {
+	t.Helper()
+	SetWstunnelHostCacheFile("")
+	answers := make(map[string][]netip.Addr, len(hosts))
+	for name, addrs := range hosts {
+		for _, a := range addrs {
+			answers[name] = append(answers[name], netip.MustParseAddr(a))
+		}
+	}
+	old := resolveHostnameFunc
+	t.Cleanup(func() { resolveHostnameFunc = old })
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		addrs, ok := answers[name]
+		if !ok {
+			return nil, errFakeNoSuchHost
+		}
+		return addrs, nil
+	}
+}
+
+func TestParseWstunnelHostExcludes(t *testing.T) {
+	fakeResolver(t, map[string][]string{
+		"vpn.example.com":  {"192.0.2.1"},
+		"dual.example.com": {"198.51.100.7", "2001:db8::7"},
+	})
+	tests := []struct {
+		input    string
+		excludes []string
+		err      error
+	}{
+		{"192.0.2.1", []string{"192.0.2.1/32"}, nil},
+		{"[2001:db8::1]:443", []string{"2001:db8::1/128"}, nil},
+		{"10.0.0.0/8, 2001:db8::/32", []string{"10.0.0.0/8", "2001:db8::/32"}, nil},
+		{"vpn.example.com", []string{"192.0.2.1/32"}, nil},
+		{"wss://vpn.example.com:8443/tunnel", []string{"192.0.2.1/32"}, nil},
+		{"dual.example.com:443", []string{"198.51.100.7/32", "2001:db8::7/128"}, nil},
+		{"missing.example.com", nil, errFakeNoSuchHost},
+		{"vpn.example.com, missing.example.com", []string{"192.0.2.1/32"}, errFakeNoSuchHost},
+	}
+	for _, test := range tests {
+		excludes, err := parseWstunnelHostExcludes(test.input)
+		if test.err == nil {
+			noError(t, err)
+		} else if !errors.Is(err, test.err) {
+			t.Errorf("%q: expected %v, got %v", test.input, test.err, err)
+		}
+		if len(test.excludes) == 0 {
+			lenTest(t, excludes, 0)
+		} else {
+			equal(t, parsePrefixes(t, test.excludes...), excludes)
+		}
+	}
+}
+
+func TestCoalescePrefixes(t *testing.T) {
+	actual := coalescePrefixes(parsePrefixes(t, "10.0.0.0/9", "10.128.0.0/9", "11.0.0.0/8", "192.168.1.0/24", "::/1", "8000::/1"))
+	equal(t, parsePrefixes(t, "10.0.0.0/7", "192.168.1.0/24", "::/0"), actual)
+
+	actual = coalescePrefixes(parsePrefixes(t, "0.0.0.0/1", "::/1"))
+	equal(t, parsePrefixes(t, "0.0.0.0/1", "::/1"), actual)
+}
+
+func TestSubtractPrefixListCoalesces(t *testing.T) {
+	base := parsePrefixes(t, "10.0.0.0/8")
+	actual, err := subtractPrefixList(base, parsePrefixes(t, "10.1.2.3/32"))
+	noError(t, err)
+	lenTest(t, actual, 24)
+	actual, err = subtractPrefixList(actual, nil)
+	noError(t, err)
+	lenTest(t, actual, 24)
+	actual = coalescePrefixes(append(actual, parsePrefixes(t, "10.1.2.3/32")...))
+	equal(t, base, actual)
+}
+
+func TestSubtractPrefixListSortsAndDedupes(t *testing.T) {
+	base := parsePrefixes(t, "fd00::/64", "192.168.0.0/24", "10.1.0.0/16", "10.0.0.0/24", "192.168.0.0/24")
+	actual, err := subtractPrefixList(base, parsePrefixes(t, "10.0.0.0/25"))
+	noError(t, err)
+	equal(t, parsePrefixes(t, "10.0.0.128/25", "10.1.0.0/16", "192.168.0.0/24", "fd00::/64"), actual)
+}
+
+func TestParseWstunnelHostExcludesDedupes(t *testing.T) {
+	fakeResolver(t, map[string][]string{
+		"a.example.com": {"192.0.2.1", "2001:db8::1"},
+		"b.example.com": {"192.0.2.1"},
+	})
+	excludes, err := parseWstunnelHostExcludes("a.example.com, b.example.com, 192.0.2.1:443, a.example.com")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32", "2001:db8::1/128"), excludes)
+	}
+}
+
+func TestParseWstunnelHostFile(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	path := filepath.Join(t.TempDir(), "excludes.txt")
+	contents := "# wstunnel servers\r\nvpn.example.com\r\n\n  198.51.100.0/24\n@other.txt\nmissing.example.com\n2001:db8::/32\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := parseWstunnelHostExcludes("10.0.0.0/8, @" + path)
+	equal(t, parsePrefixes(t, "10.0.0.0/8", "192.0.2.1/32", "198.51.100.0/24", "2001:db8::/32"), excludes)
+	if !errors.Is(err, errFakeNoSuchHost) || !strings.Contains(err.Error(), path+":5:") || !strings.Contains(err.Error(), path+":6:") {
+		t.Errorf("expected errors naming lines 5 and 6, got %v", err)
+	}
+
+	_, err = parseWstunnelHostExcludes("@" + filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+	port, err := wstunnelHostPort("@" + path + ", vpn.example.com:443")
+	if noError(t, err) {
+		equal(t, uint16(443), port)
+	}
+}
+
+func TestVerifyResolvedHost(t *testing.T) {
+	fakeResolver(t, map[string][]string{
+		"vpn.example.com":    {"192.0.2.1"},
+		"hijack.example.com": {"192.0.2.9", "203.0.113.5"},
+	})
+	defer func(old func(string, netip.Addr) error) { VerifyResolvedHost = old }(VerifyResolvedHost)
+	errHijacked := errors.New("PTR mismatch")
+	var mu sync.Mutex
+	var verified []string
+	VerifyResolvedHost = func(host string, addr netip.Addr) error {
+		mu.Lock()
+		verified = append(verified, host+" "+addr.String())
+		mu.Unlock()
+		if addr == netip.MustParseAddr("203.0.113.5") {
+			return errHijacked
+		}
+		return nil
+	}
+	excludes, err := parseWstunnelHostExcludes("vpn.example.com, 198.51.100.7, hijack.example.com/24")
+	if !errors.Is(err, errHijacked) || !strings.Contains(err.Error(), "203.0.113.5") {
+		t.Errorf("expected verification error, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32", "198.51.100.7/32"), excludes)
+	// Hostnames are resolved concurrently, so only the set of calls is fixed.
+	sort.Strings(verified)
+	equal(t, []string{"hijack.example.com 192.0.2.9", "hijack.example.com 203.0.113.5", "vpn.example.com 192.0.2.1"}, verified)
+}
+
+func TestWstunnelHostErrorKinds(t *testing.T) {
+	fakeResolver(t, nil)
+	tests := []struct {
+		input, entry, host string
+		kind               error
+	}{
+		{"missing.example.com:443", "missing.example.com:443", "missing.example.com", ErrWstunnelHostUnresolvable},
+		{"missing.example.com/24", "missing.example.com/24", "missing.example.com", ErrWstunnelHostUnresolvable},
+		{"10.0.0.1/33", "10.0.0.1/33", "", ErrWstunnelHostInvalid},
+		{"ftp://vpn.example.com", "ftp://vpn.example.com", "", ErrWstunnelHostInvalid},
+		{" , ", " , ", "", ErrWstunnelHostInvalid},
+	}
+	for _, test := range tests {
+		_, err := parseWstunnelHostExcludes(test.input)
+		if !errors.Is(err, test.kind) {
+			t.Errorf("%q: expected %v, got %v", test.input, test.kind, err)
+		}
+		var hostErr *WstunnelHostError
+		if errors.As(err, &hostErr) {
+			equal(t, test.entry, hostErr.Entry)
+			equal(t, test.host, hostErr.Host)
+		} else {
+			t.Errorf("%q: expected a WstunnelHostError, got %v", test.input, err)
+		}
+	}
+	_, err := parseWstunnelHostExcludes("missing.example.com")
+	if !errors.Is(err, errFakeNoSuchHost) || errors.Is(err, ErrWstunnelHostInvalid) {
+		t.Errorf("expected only a resolution error, got %v", err)
+	}
+}
+
+func TestWstunnelHostKeepEntries(t *testing.T) {
+	fakeResolver(t, map[string][]string{"inside.example.com": {"10.1.2.3"}})
+	excludes, err := parseWstunnelHostExcludes("!10.1.0.0/16, 10.0.0.0/8, ! inside.example.com")
+	if noError(t, err) {
+		lenTest(t, excludes, 8)
+		for _, p := range excludes {
+			if p.Overlaps(netip.MustParsePrefix("10.1.0.0/16")) {
+				t.Errorf("%s excludes a kept address", p)
+			}
+		}
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "10.0.0.0/8, !10.1.0.0/16, !192.168.0.0/16"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8")},
+			{AllowedIPs: parsePrefixes(t, "10.1.2.0/24", "10.2.0.0/16")},
+		},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		equal(t, parsePrefixes(t, "10.1.0.0/16"), config.Peers[0].AllowedIPs)
+		equal(t, parsePrefixes(t, "10.1.2.0/24"), config.Peers[1].AllowedIPs)
+	}
+	config.Interface.WstunnelHost = "!10.0.0.0/8, 10.1.0.0/16"
+	if excludes, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		lenTest(t, excludes, 0)
+		equal(t, parsePrefixes(t, "10.0.0.0/8"), config.Peers[0].AllowedIPs)
+	}
+
+	config = &Config{
+		Interface: Interface{WstunnelHost: "10.0.0.0/8, !10.1.2.0/24"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		for addr, routed := range map[string]bool{"10.0.0.1": false, "10.1.2.1": true, "10.1.3.1": false, "192.0.2.1": true} {
+			if _, ok := config.RoutesAddr(netip.MustParseAddr(addr)); ok != routed {
+				t.Errorf("RoutesAddr(%s) = %v, want %v", addr, ok, routed)
+			}
+		}
+	}
+}
+
+func TestWstunnelDisableExclusion(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1", WstunnelDisableExclusion: true},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	noError(t, err)
+	lenTest(t, excludes, 0)
+	equal(t, parsePrefixes(t, "0.0.0.0/0"), config.Peers[0].AllowedIPs)
+	lenTest(t, config.Peers[0].OriginalAllowedIPs, 0)
+	equal(t, []string{"WSTUNNEL_HOST exclusions are disabled by WSTUNNEL_DISABLE_EXCLUSION, so AllowedIPs are left unchanged"}, lines)
+}
+
+func TestApplyWstunnelHostExclusionsContext(t *testing.T) {
+	defer func(old func(context.Context, string) ([]netip.Addr, error)) { resolveHostnameFunc = old }(resolveHostnameFunc)
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		if name == "fast.example.com" {
+			return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "fast.example.com, hung.example.com, 198.51.100.0/24"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	excludes, err := config.ApplyWstunnelHostExclusionsContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	lenTest(t, excludes, 0)
+	equal(t, parsePrefixes(t, "0.0.0.0/0"), config.Peers[0].AllowedIPs)
+	lenTest(t, config.Peers[0].OriginalAllowedIPs, 0)
+}
+
+func TestParseWstunnelHostConcurrentResolution(t *testing.T) {
+	defer func(old int) { WstunnelHostResolveConcurrency = old }(WstunnelHostResolveConcurrency)
+	WstunnelHostResolveConcurrency = 2
+	delays := map[string]time.Duration{"a.example.com": 40 * time.Millisecond, "b.example.com": 30 * time.Millisecond, "c.example.com": 20 * time.Millisecond, "d.example.com": 10 * time.Millisecond}
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	defer func(old func(context.Context, string) ([]netip.Addr, error)) { resolveHostnameFunc = old }(resolveHostnameFunc)
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		delay, ok := delays[name]
+		if !ok {
+			return nil, errFakeNoSuchHost
+		}
+		time.Sleep(delay)
+		return []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 2, name[0]})}, nil
+	}
+	excludes, err := parseWstunnelHostExcludes("a.example.com, 198.51.100.1, b.example.com, c.example.com, missing.example.com, d.example.com")
+	if !errors.Is(err, ErrWstunnelHostUnresolvable) || !strings.Contains(err.Error(), "entry 5 of 6") {
+		t.Errorf("expected entry 5 to be unresolvable, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "192.0.2.97/32", "198.51.100.1/32", "192.0.2.98/32", "192.0.2.99/32", "192.0.2.100/32"), excludes)
+	if maxInFlight != 2 {
+		t.Errorf("resolved %d hostnames at once, want 2", maxInFlight)
+	}
+}
+
+func TestParseWstunnelHostLocalAddresses(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	fakeResolver(t, map[string][]string{"localhost": {"127.0.0.1", "::1"}})
+	excludes, err := parseWstunnelHostExcludes("localhost, 169.254.1.1, 0.0.0.0, 0.0.0.0/0, 192.0.2.1")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "127.0.0.1/32", "::1/128", "169.254.1.1/32", "0.0.0.0/32", "0.0.0.0/0", "192.0.2.1/32"), excludes)
+	}
+	equal(t, []string{
+		`Warning: WSTUNNEL_HOST "localhost" refers to local address 127.0.0.1/32, ::1/128 rather than the remote wstunnel server, so excluding it has no effect`,
+		`Warning: WSTUNNEL_HOST "169.254.1.1" refers to local address 169.254.1.1/32 rather than the remote wstunnel server, so excluding it has no effect`,
+		`Warning: WSTUNNEL_HOST "0.0.0.0" refers to local address 0.0.0.0/32 rather than the remote wstunnel server, so excluding it has no effect`,
+	}, lines)
+
+	defer func(old bool) { RejectLocalWstunnelHost = old }(RejectLocalWstunnelHost)
+	RejectLocalWstunnelHost = true
+	excludes, err = parseWstunnelHostExcludes("127.0.0.1:8080, [fe80::1], 192.0.2.1")
+	if !errors.Is(err, ErrWstunnelHostInvalid) || !strings.Contains(err.Error(), "entry 1 of 3") || !strings.Contains(err.Error(), "entry 2 of 3") {
+		t.Errorf("expected local addresses to be rejected, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+}
+
+func TestWstunnelStats(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	before := WstunnelStats()
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com, missing.example.com, 198.51.100.7, vpn.example.com/24"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+	}
+	config.ApplyWstunnelHostExclusions()
+	after := WstunnelStats()
+	equal(t, uint64(2), after.ResolutionSuccesses-before.ResolutionSuccesses)
+	equal(t, uint64(1), after.ResolutionFailures-before.ResolutionFailures)
+	equal(t, uint64(3), after.ExcludesApplied-before.ExcludesApplied)
+}
+
+func TestParseWstunnelHostZones(t *testing.T) {
+	fakeResolver(t, map[string][]string{"scoped.example.com": {"fe80::7%2"}})
+	excludes, err := parseWstunnelHostExcludes("fe80::1%eth0, [fe80::2%eth0]:443, fe80::3%eth0/64, wss://[fe80::4%25eth0]:443/, scoped.example.com")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "fe80::1/128", "fe80::2/128", "fe80::/64", "fe80::4/128", "fe80::7/128"), excludes)
+	}
+	if _, err := parseWstunnelHostExcludes("fe80::1%eth0/129"); err == nil {
+		t.Error("expected error for /129")
+	}
+}
+
+func TestValidateWstunnelHost(t *testing.T) {
+	defer func(old func(context.Context, string) ([]netip.Addr, error)) { resolveHostnameFunc = old }(resolveHostnameFunc)
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		t.Errorf("unexpected lookup of %s", name)
+		return nil, errFakeNoSuchHost
+	}
+	for _, valid := range []string{
+		"vpn.example.com",
+		"vpn.example.com.",
+		"wss://vpn.example.com:8443/ws, 198.51.100.0/24",
+		"192.0.2.1:443, [2001:db8::1]:443, fe80::1%eth0/64",
+		"edge.example.com/24, !10.0.0.0/8, @C:\\excludes.txt",
+		"my_host-1",
+	} {
+		noError(t, ValidateWstunnelHostSyntax(valid))
+	}
+	for _, invalid := range []string{
+		"",
+		"vpn..example.com",
+		"-vpn.example.com",
+		"vpn.example.com:99999",
+		"192.0.2",
+		"10.0.0.1/33",
+		"192.0.2.1/x",
+		"edge.example.com/129",
+		"ftp://vpn.example.com",
+		"vpn.example.com, bad host",
+		"@",
+	} {
+		if err := ValidateWstunnelHost(invalid); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("%q: expected invalid, got %v", invalid, err)
+		}
+	}
+	err := ValidateWstunnelHost("192.0.2.1, vpn.example.com:0x1, also bad")
+	if err == nil || !strings.Contains(err.Error(), "entry 2 of 3") {
+		t.Errorf("expected error naming entry 2, got %v", err)
+	}
+}
+
+func TestWstunnelHostSyntaxAgrees(t *testing.T) {
+	defer func(old func(context.Context, string) ([]netip.Addr, error)) { resolveHostnameFunc = old }(resolveHostnameFunc)
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		t.Errorf("unexpected lookup of %s", name)
+		return nil, errFakeNoSuchHost
+	}
+	for _, invalid := range []string{"!", "-", "1.2.3", "auto-subnet:10.0.0.1-10.0.0.2", "hosts:192.0.2.1", "@endpoint:0"} {
+		if err := ValidateWstunnelHostSyntax(invalid); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("ValidateWstunnelHostSyntax(%q) = %v, want ErrWstunnelHostInvalid", invalid, err)
+		}
+		if _, err := wstunnelHostPort(invalid); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("wstunnelHostPort(%q) = %v, want ErrWstunnelHostInvalid", invalid, err)
+		}
+		if _, err := parseWstunnelHostExcludes(invalid); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("parseWstunnelHostExcludes(%q) = %v, want ErrWstunnelHostInvalid", invalid, err)
+		}
+	}
+}
+
+func TestValidateWstunnelHostResolvable(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	noError(t, ValidateWstunnelHostResolvable(context.Background(), "vpn.example.com:443, 10.0.0.0/8"))
+	err := ValidateWstunnelHostResolvable(context.Background(), "gone.example.com, vpn.example.com, !missing.example.com/24")
+	if !errors.Is(err, ErrWstunnelHostUnresolvable) || !strings.Contains(err.Error(), "entry 1 of 3") || !strings.Contains(err.Error(), "entry 3 of 3") {
+		t.Errorf("expected entries 1 and 3 to be reported, got %v", err)
+	}
+	if err := ValidateWstunnelHostResolvable(context.Background(), "gone.example.com, bad..name"); !errors.Is(err, ErrWstunnelHostInvalid) || errors.Is(err, ErrWstunnelHostUnresolvable) {
+		t.Errorf("expected only the syntax error, got %v", err)
+	}
+}
+
+func TestApplyWstunnelHostExclusionsPerPeer(t *testing.T) {
+	fakeResolver(t, map[string][]string{
+		"a.example.com": {"192.0.2.1"},
+		"b.example.com": {"198.51.100.1"},
+	})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "a.example.com"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/31", "198.51.100.0/31")},
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/31", "198.51.100.0/31"), WstunnelHost: "b.example.com"},
+		},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32", "198.51.100.1/32"), excludes)
+	equal(t, parsePrefixes(t, "192.0.2.0/32", "198.51.100.0/31"), config.Peers[0].AllowedIPs)
+	equal(t, parsePrefixes(t, "192.0.2.0/31", "198.51.100.0/32"), config.Peers[1].AllowedIPs)
+
+	config.Interface.WstunnelHost = ""
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.0/31", "198.51.100.0/31"), config.Peers[0].AllowedIPs)
+		equal(t, parsePrefixes(t, "192.0.2.0/31", "198.51.100.0/32"), config.Peers[1].AllowedIPs)
+	}
+}
+
+func TestApplyWstunnelHostExclusionsDNS(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	config := &Config{
+		Interface: Interface{
+			WstunnelHost: "vpn.example.com",
+			DNS:          []netip.Addr{netip.MustParseAddr("192.0.2.53"), netip.MustParseAddr("2001:db8::53")},
+		},
+		Peers: []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/26")}},
+	}
+	excludes, _, err := config.computeWstunnelHostExclusions(context.Background())
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+	}
+
+	config.Interface.WstunnelExcludeDNS = true
+	excludes, err = config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32", "192.0.2.53/32", "2001:db8::53/128"), excludes)
+	equal(t, parsePrefixes(t, "192.0.2.0/32", "192.0.2.2/31", "192.0.2.4/30", "192.0.2.8/29", "192.0.2.16/28",
+		"192.0.2.32/28", "192.0.2.48/30", "192.0.2.52/32", "192.0.2.54/31", "192.0.2.56/29"), config.Peers[0].AllowedIPs)
+}
+
+func TestRoutesAddr(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")},
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8", "2001:db8::/32")},
+		},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	tests := []struct {
+		addr string
+		peer int
+		ok   bool
+	}{
+		{"192.0.2.1", 0, false},
+		{"192.0.2.2", 0, true},
+		{"10.1.2.3", 1, true},
+		{"::ffff:10.1.2.3", 1, true},
+		{"2001:db8::1", 1, true},
+		{"2001:db9::1", 0, false},
+	}
+	for _, tt := range tests {
+		peer, ok := config.RoutesAddr(netip.MustParseAddr(tt.addr))
+		if peer != tt.peer || ok != tt.ok {
+			t.Errorf("RoutesAddr(%s) = %d, %v; want %d, %v", tt.addr, peer, ok, tt.peer, tt.ok)
+		}
+	}
+
+	tied := &Config{
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8")},
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8")},
+		},
+	}
+	if peer, ok := tied.RoutesAddr(netip.MustParseAddr("10.1.2.3")); peer != 1 || !ok {
+		t.Errorf("RoutesAddr(10.1.2.3) with tied peers = %d, %v; want 1, true", peer, ok)
+	}
+}
+
+func TestStartWstunnelHostWatcher(t *testing.T) {
+	var mu sync.Mutex
+	addr := netip.MustParseAddr("192.0.2.1")
+	old := resolveHostnameFunc
+	t.Cleanup(func() { resolveHostnameFunc = old })
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []netip.Addr{addr}, nil
+	}
+	changed := make(chan []netip.Prefix, 1)
+	OnWstunnelHostChanged = func(config *Config, excludes []netip.Prefix) { changed <- excludes }
+	t.Cleanup(func() { OnWstunnelHostChanged = nil })
+
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/30")}},
+	}
+	applied, err := config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	var lookups atomic.Int32
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		lookups.Add(1)
+		mu.Lock()
+		defer mu.Unlock()
+		return []netip.Addr{addr}, nil
+	}
+	stop := StartWstunnelHostWatcher(config, applied, nil, time.Hour)
+	select {
+	case excludes := <-changed:
+		t.Fatalf("watcher re-applied unchanged excludes %s", prefixListToString(excludes))
+	case <-time.After(20 * time.Millisecond):
+	}
+	stop()
+	equal(t, int32(1), lookups.Load())
+
+	mu.Lock()
+	addr = netip.MustParseAddr("192.0.2.2")
+	mu.Unlock()
+	stop = StartWstunnelHostWatcher(config, applied, nil, time.Hour)
+	defer stop()
+	select {
+	case excludes := <-changed:
+		equal(t, parsePrefixes(t, "192.0.2.2/32"), excludes)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not notice the new address")
+	}
+	stop()
+	stop()
+	equal(t, int32(2), lookups.Load())
+	equal(t, parsePrefixes(t, "192.0.2.0/31", "192.0.2.3/32"), config.Peers[0].AllowedIPs)
+	equal(t, parsePrefixes(t, "192.0.2.0/30"), config.Peers[0].OriginalAllowedIPs)
+}
+
+func TestStartWstunnelHostWatcherExtra(t *testing.T) {
+	var mu sync.Mutex
+	addr := netip.MustParseAddr("192.0.2.1")
+	old := resolveHostnameFunc
+	t.Cleanup(func() { resolveHostnameFunc = old })
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []netip.Addr{addr}, nil
+	}
+	changed := make(chan []netip.Prefix, 1)
+	OnWstunnelHostChanged = func(config *Config, excludes []netip.Prefix) { changed <- excludes }
+	t.Cleanup(func() { OnWstunnelHostChanged = nil })
+
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/30", "198.51.100.0/23")}},
+	}
+	extra := parsePrefixes(t, "198.51.100.0/24")
+	applied, err := config.ApplyExclusions(extra)
+	if !noError(t, err) {
+		return
+	}
+	mu.Lock()
+	addr = netip.MustParseAddr("192.0.2.2")
+	mu.Unlock()
+	stop := StartWstunnelHostWatcher(config, applied, extra, time.Hour)
+	defer stop()
+	select {
+	case excludes := <-changed:
+		equal(t, parsePrefixes(t, "192.0.2.2/32", "198.51.100.0/24"), excludes)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not notice the new address")
+	}
+	stop()
+	equal(t, parsePrefixes(t, "192.0.2.0/31", "192.0.2.3/32", "198.51.101.0/24"), config.Peers[0].AllowedIPs)
+}
+
+func TestParseWstunnelHostEnv(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}, "env": {"198.51.100.1"}})
+	t.Setenv("VPN_HOST", " wss://vpn.example.com:8443 ")
+	t.Setenv("VPN_NET", "203.0.113.0/24")
+	t.Setenv("VPN_EMPTY", "")
+	t.Setenv("VPN_LIST", "192.0.2.1, 192.0.2.2")
+	t.Setenv("VPN_NESTED", "env:VPN_HOST")
+
+	excludes, err := parseWstunnelHostExcludes("env:VPN_HOST, env:VPN_NET, env:443")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32", "203.0.113.0/24", "198.51.100.1/32"), excludes)
+	}
+	for _, input := range []string{"env:VPN_UNSET", "env:VPN_EMPTY", "env:VPN_LIST", "env:VPN_NESTED"} {
+		if _, err := parseWstunnelHostExcludes(input); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("parseWstunnelHostExcludes(%q) = %v, want ErrWstunnelHostInvalid", input, err)
+		}
+	}
+	noError(t, ValidateWstunnelHostSyntax("env:VPN_UNSET"))
+	if port, err := wstunnelHostPort("env:VPN_HOST, vpn.example.com:443"); noError(t, err) {
+		equal(t, uint16(443), port)
+	}
+}
+
+func TestParseWstunnelHostBraces(t *testing.T) {
+	fakeResolver(t, map[string][]string{
+		"edge1.vpn.example.com": {"192.0.2.1"},
+		"edge2.vpn.example.com": {"192.0.2.2", "2001:db8::2"},
+		"edge3.vpn.example.com": {"192.0.2.3"},
+		"edge09.example.com":    {"198.51.100.9"},
+		"edge10.example.com":    {"198.51.100.10"},
+	})
+	excludes, err := parseWstunnelHostExcludes("wss://edge{1..3}.vpn.example.com:443, edge{09..10}.example.com")
+	if noError(t, err) {
+		equal(t, "192.0.2.1/32, 192.0.2.2/32, 2001:db8::2/128, 192.0.2.3/32, 198.51.100.9/32, 198.51.100.10/32", prefixListToString(excludes))
+	}
+	excludes, err = parseWstunnelHostExcludes("edge{1..4}.vpn.example.com")
+	if !errors.Is(err, ErrWstunnelHostUnresolvable) || len(excludes) != 4 {
+		t.Errorf("expected edge4 alone to fail, got %v, %v", excludes, err)
+	}
+	if names, ok, err := expandWstunnelHostBraces("10.{0..1}.{1..2}.1"); ok && noError(t, err) {
+		equal(t, []string{"10.0.1.1", "10.0.2.1", "10.1.1.1", "10.1.2.1"}, names)
+	}
+	for _, input := range []string{"edge{1..4.example.com", "edge1..4}.example.com", "edge{a..c}.example.com", "edge{4..1}.example.com", "edge{1,2}.example.com", "edge{}.example.com", "edge{0..1000}.example.com"} {
+		if err := ValidateWstunnelHostSyntax(input); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("ValidateWstunnelHostSyntax(%q) = %v, want ErrWstunnelHostInvalid", input, err)
+		}
+	}
+	noError(t, ValidateWstunnelHostSyntax("edge{1..4}.vpn.example.com:443"))
+}
+
+func TestParseWstunnelHostSpec(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"203.0.113.5"}})
+	spec, err := ParseWstunnelHostSpec("wss://192.0.2.1:443, 10.0.0.0/8, !10.1.0.0/16, vpn.example.com, vpn.example.com/24, @gateway, missing.example.com")
+	if !noError(t, err) {
+		return
+	}
+	var kinds []string
+	for _, entry := range spec.Entries {
+		kinds = append(kinds, entry.Kind.String())
+	}
+	equal(t, []string{"address", "prefix", "prefix", "hostname", "hostname", "token", "hostname"}, kinds)
+	equal(t, "10.1.0.0/16", spec.Entries[2].Text)
+	equal(t, true, spec.Entries[2].Keep)
+	equal(t, parsePrefixes(t, "192.0.2.1/32"), spec.Entries[0].Prefixes)
+	lenTest(t, spec.Entries[3].Prefixes, 0)
+
+	defer func(old func() ([]netip.Addr, error)) { resolveGateway = old }(resolveGateway)
+	SetGatewayResolver(func() ([]netip.Addr, error) { return []netip.Addr{netip.MustParseAddr("192.168.1.1")}, nil })
+	err = spec.Resolve(context.Background())
+	if !errors.Is(err, ErrWstunnelHostUnresolvable) || !strings.Contains(err.Error(), "entry 7 of 7") {
+		t.Errorf("expected missing.example.com to fail, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "203.0.113.5/32"), spec.Entries[3].Prefixes)
+	equal(t, parsePrefixes(t, "203.0.113.0/24"), spec.Entries[4].Prefixes)
+	equal(t, parsePrefixes(t, "192.168.1.1/32"), spec.Entries[5].Prefixes)
+	lenTest(t, spec.Entries[6].Prefixes, 0)
+
+	if _, err := ParseWstunnelHostSpec("vpn.example.com, 10.0.0.1/33"); !errors.Is(err, ErrWstunnelHostInvalid) {
+		t.Errorf("expected invalid prefix to fail, got %v", err)
+	}
+}
+
+func TestMinimalCover(t *testing.T) {
+	addrs := func(s ...string) []netip.Addr {
+		var out []netip.Addr
+		for _, a := range s {
+			out = append(out, netip.MustParseAddr(a))
+		}
+		return out
+	}
+	equal(t, parsePrefixes(t, "203.0.113.0/30"), minimalCover(addrs("203.0.113.1", "203.0.113.2", "203.0.113.3")))
+	equal(t, parsePrefixes(t, "203.0.113.0/24"), minimalCover(addrs("203.0.113.1", "::ffff:203.0.113.200")))
+	equal(t, parsePrefixes(t, "198.51.100.1/32", "203.0.113.1/32"), minimalCover(addrs("203.0.113.1", "198.51.100.1")))
+	equal(t, parsePrefixes(t, "192.0.2.7/32", "2001:db8::/126"), minimalCover(addrs("2001:db8::1", "192.0.2.7", "2001:db8::2")))
+	equal(t, parsePrefixes(t, "2001:db8::1/128", "2001:db8:1::1/128"), minimalCover(addrs("2001:db8::1", "2001:db8:1::1")))
+
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"203.0.113.1", "203.0.113.2", "203.0.113.3"}})
+	excludes, err := parseWstunnelHostExcludes("vpn.example.com, 192.0.2.1")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "203.0.113.1/32", "203.0.113.2/32", "203.0.113.3/32", "192.0.2.1/32"), excludes)
+	}
+	CompactWstunnelHostExcludes = true
+	t.Cleanup(func() { CompactWstunnelHostExcludes = false })
+	excludes, err = parseWstunnelHostExcludes("vpn.example.com, 192.0.2.1")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "203.0.113.0/30", "192.0.2.1/32"), excludes)
+	}
+}
+
+func TestPreviewWstunnelHostExclusionReport(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com"},
+		Peers: []Peer{
+			{PublicKey: Key{1}, AllowedIPs: parsePrefixes(t, "192.0.2.0/30")},
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8")},
+		},
+	}
+	reports, err := config.PreviewWstunnelHostExclusionReport()
+	if !noError(t, err) {
+		return
+	}
+	out, err := json.Marshal(reports)
+	if noError(t, err) {
+		const want = `[{"peer":0,"public_key":"AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","removed":["192.0.2.1/32"],"allowed_ips":["192.0.2.0/32","192.0.2.2/31"]},` +
+			`{"peer":1,"removed":[],"allowed_ips":["10.0.0.0/8"]}]`
+		equal(t, want, string(out))
+	}
+}
+
+func TestSubtractAddr(t *testing.T) {
+	for _, tt := range []struct{ base, addr string }{
+		{"0.0.0.0/0", "192.0.2.1"},
+		{"192.0.2.0/24", "192.0.2.255"},
+		{"192.0.2.1/32", "192.0.2.1"},
+		{"2001:db8::/32", "2001:db8::1"},
+	} {
+		base, addr := netip.MustParsePrefix(tt.base), netip.MustParseAddr(tt.addr)
+		want := subtractPrefix(base, prefixFromAddr(addr))
+		sortPrefixes(want)
+		got := subtractAddr(base, addr)
+		sortPrefixes(got)
+		equal(t, prefixListToString(want), prefixListToString(got))
+	}
+}
+
+func TestParseWstunnelHostGateway(t *testing.T) {
+	defer func(old func() ([]netip.Addr, error)) { resolveGateway = old }(resolveGateway)
+	if _, err := parseWstunnelHostExcludes("@gateway"); !errors.Is(err, ErrWstunnelHostUnresolvable) {
+		t.Errorf("expected unsupported @gateway to be unresolvable, got %v", err)
+	}
+
+	SetGatewayResolver(func() ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("::ffff:192.0.2.254"), netip.MustParseAddr("2001:db8::fe")}, nil
+	})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gateway")
+	if err := os.WriteFile(path, []byte("@GATEWAY\n198.51.100.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := parseWstunnelHostExcludes("@gateway, @" + path)
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.254/32", "2001:db8::fe/128", "198.51.100.1/32"), excludes)
+	}
+	noError(t, ValidateWstunnelHostSyntax("@gateway"))
+
+	SetGatewayResolver(func() ([]netip.Addr, error) { return nil, nil })
+	if _, err := parseWstunnelHostExcludes("@gateway"); err == nil || !strings.Contains(err.Error(), "no default gateway found") {
+		t.Errorf("expected missing gateway error, got %v", err)
+	}
+}
+
+func TestParseWstunnelHostRange(t *testing.T) {
+	fakeResolver(t, map[string][]string{"edge-1.example.com": {"198.51.100.1"}})
+	excludes, err := parseWstunnelHostExcludes("203.0.113.10-203.0.113.20, 2001:db8::-2001:db8::1, 192.0.2.7 - 192.0.2.7, edge-1.example.com")
+	if noError(t, err) {
+		equal(t, "203.0.113.10/31, 203.0.113.12/30, 203.0.113.16/30, 203.0.113.20/32, 2001:db8::/127, 192.0.2.7/32, 198.51.100.1/32", prefixListToString(excludes))
+	}
+	for _, tt := range []struct{ from, to, want string }{
+		{"0.0.0.0", "255.255.255.255", "0.0.0.0/0"},
+		{"10.0.0.0", "10.0.1.255", "10.0.0.0/23"},
+		{"10.0.0.255", "10.0.1.0", "10.0.0.255/32, 10.0.1.0/32"},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::/0"},
+		{"2001:db8::1", "2001:db8::6", "2001:db8::1/128, 2001:db8::2/127, 2001:db8::4/127, 2001:db8::6/128"},
+	} {
+		equal(t, tt.want, prefixListToString(rangeToPrefixes(netip.MustParseAddr(tt.from), netip.MustParseAddr(tt.to))))
+	}
+	for _, input := range []string{"203.0.113.20-203.0.113.10", "192.0.2.1-2001:db8::1", "fe80::1%eth0-fe80::2"} {
+		if err := ValidateWstunnelHostSyntax(input); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("ValidateWstunnelHostSyntax(%q) = %v, want ErrWstunnelHostInvalid", input, err)
+		}
+	}
+}
+
+func TestParseWstunnelHostAutoSubnet(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.77", "2001:db8::77"}})
+	defer func(old func(netip.Addr) (netip.Prefix, error)) { resolveOnLinkPrefix = old }(resolveOnLinkPrefix)
+	if _, err := parseWstunnelHostExcludes("auto-subnet:vpn.example.com"); !errors.Is(err, ErrWstunnelHostUnresolvable) {
+		t.Errorf("expected unsupported auto-subnet to be unresolvable, got %v", err)
+	}
+
+	SetOnLinkPrefixResolver(func(addr netip.Addr) (netip.Prefix, error) {
+		if addr.Is4() {
+			return netip.MustParsePrefix("192.0.2.64/26"), nil
+		}
+		return netip.MustParsePrefix("2001:db8::/64"), nil
+	})
+	excludes, err := parseWstunnelHostExcludes("auto-subnet:wss://vpn.example.com:443, auto-subnet:198.51.100.1, auto-subnet:443")
+	if !errors.Is(err, ErrWstunnelHostUnresolvable) || !strings.Contains(err.Error(), "198.51.100.1 is not within it") {
+		t.Errorf("expected 198.51.100.1 to be outside its on-link prefix, got %v", err)
+	}
+	equal(t, "192.0.2.64/26, 2001:db8::/64", prefixListToString(excludes))
+
+	for _, input := range []string{"auto-subnet:10.0.0.0/8", "auto-subnet:@gateway", "auto-subnet:env:HOST", "auto-subnet:auto-subnet:vpn.example.com", "auto-subnet:asn:cloud"} {
+		if err := ValidateWstunnelHostSyntax(input); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("ValidateWstunnelHostSyntax(%q) = %v, want ErrWstunnelHostInvalid", input, err)
+		}
+	}
+	noError(t, ValidateWstunnelHostSyntax("auto-subnet:edge{1..2}.example.com, auto-subnet:[2001:db8::1]:443"))
+}
+
+func TestParseWstunnelHostsAlias(t *testing.T) {
+	fakeResolver(t, map[string][]string{"hosts": {"192.0.2.1"}})
+	defer func(old func() ([]byte, error)) { readHostsFile = old }(readHostsFile)
+	errNoHostsFile := errors.New("no hosts file")
+	SetHostsFileReader(func() ([]byte, error) { return nil, errNoHostsFile })
+	if _, err := parseWstunnelHostExcludes("hosts:vpn.example.com"); !errors.Is(err, ErrWstunnelHostUnresolvable) || !errors.Is(err, errNoHostsFile) {
+		t.Errorf("expected unreadable hosts file to be unresolvable, got %v", err)
+	}
+
+	SetHostsFileReader(func() ([]byte, error) {
+		return []byte("# Copyright (c) Microsoft Corp.\r\n" +
+			"127.0.0.1 localhost\r\n" +
+			"203.0.113.7\tVPN.example.com. vpn # pinned\r\n" +
+			"#198.51.100.1 vpn.example.com\r\n" +
+			"2001:db8::7 vpn.example.com\r\n" +
+			"203.0.113.7 vpn.example.com\r\n"), nil
+	})
+	excludes, err := parseWstunnelHostExcludes("hosts:vpn.example.com, hosts:443")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "203.0.113.7/32", "2001:db8::7/128", "192.0.2.1/32"), excludes)
+	}
+	if _, err := parseWstunnelHostExcludes("hosts:other.example.com"); !errors.Is(err, ErrWstunnelHostUnresolvable) {
+		t.Errorf("expected missing alias to be unresolvable, got %v", err)
+	}
+	for _, input := range []string{"hosts:192.0.2.1", "hosts:vpn.example.com:443", "hosts:@gateway", "auto-subnet:hosts:vpn"} {
+		if err := ValidateWstunnelHostSyntax(input); !errors.Is(err, ErrWstunnelHostInvalid) {
+			t.Errorf("ValidateWstunnelHostSyntax(%q) = %v, want ErrWstunnelHostInvalid", input, err)
+		}
+	}
+	noError(t, ValidateWstunnelHostSyntax("hosts:vpn{1..2}.example.com, hosts:vpn"))
+}
+
+func TestParseWstunnelHostNamedSet(t *testing.T) {
+	fakeResolver(t, map[string][]string{"asn": {"192.0.2.1"}})
+	defer func(old func(string) ([]netip.Prefix, error)) { resolveNamedPrefixSet = old }(resolveNamedPrefixSet)
+	if _, err := parseWstunnelHostExcludes("asn:wstunnel-provider"); !errors.Is(err, ErrWstunnelHostInvalid) {
+		t.Errorf("expected missing resolver to be invalid, got %v", err)
+	}
+
+	SetNamedPrefixSetResolver(func(name string) ([]netip.Prefix, error) {
+		if name != "wstunnel-provider" {
+			return nil, errFakeNoSuchHost
+		}
+		return parsePrefixes(t, "198.51.100.0/24", "2001:db8::/32"), nil
+	})
+	excludes, err := parseWstunnelHostExcludes("asn:wstunnel-provider, asn:443")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "198.51.100.0/24", "2001:db8::/32", "192.0.2.1/32"), excludes)
+	}
+	if _, err := parseWstunnelHostExcludes("asn:other"); !errors.Is(err, ErrWstunnelHostUnresolvable) || !errors.Is(err, errFakeNoSuchHost) {
+		t.Errorf("expected lookup failure to be unresolvable, got %v", err)
+	}
+	noError(t, ValidateWstunnelHostSyntax("asn:wstunnel-provider"))
+	if port, err := wstunnelHostPort("asn:wstunnel-provider"); noError(t, err) {
+		equal(t, uint16(0), port)
+	}
+}
+
+func TestVerifySubtraction(t *testing.T) {
+	base := parsePrefixes(t, "10.0.0.0/8", "192.0.2.0/24", "2001:db8::/32")
+	remove := parsePrefixes(t, "10.1.2.3/32", "192.0.2.0/25", "2001:db8:8000::/33", "198.51.100.0/24")
+	result, err := subtractPrefixList(base, remove)
+	if !noError(t, err) {
+		return
+	}
+	noError(t, verifySubtraction(base, remove, result))
+
+	tests := []struct {
+		result []netip.Prefix
+		err    string
+	}{
+		{append(parsePrefixes(t, "10.0.0.0/16"), result...), "overlaps"},
+		{append(parsePrefixes(t, "10.1.2.3/32"), result...), "includes removed 10.1.2.3/32"},
+		{append(parsePrefixes(t, "203.0.113.0/24"), result...), "is not within"},
+		{result[1:], "covers"},
+	}
+	for _, tt := range tests {
+		if err := verifySubtraction(base, remove, tt.result); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("verifySubtraction(%s) = %v, want error containing %q", prefixListToString(tt.result), err, tt.err)
+		}
+	}
+
+	defer func(old bool) { VerifyPrefixSubtraction = old }(VerifyPrefixSubtraction)
+	VerifyPrefixSubtraction = true
+	if verified, err := subtractPrefixList(base, remove); noError(t, err) {
+		equal(t, result, verified)
+	}
+}
+
+func TestVerifyExclusionSubset(t *testing.T) {
+	equal(t, parsePrefixes(t, "10.2.0.0/16", "10.0.0.0/14"), gainedPrefixes(parsePrefixes(t, "10.0.0.0/15"), parsePrefixes(t, "10.0.0.0/16", "10.2.0.0/16", "10.1.0.0/17", "10.0.0.0/14")))
+	lenTest(t, gainedPrefixes(parsePrefixes(t, "0.0.0.0/0"), parsePrefixes(t, "0.0.0.0/1", "128.0.0.0/2")), 0)
+
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	defer func(old bool) { VerifyExclusionSubset = old }(VerifyExclusionSubset)
+	VerifyExclusionSubset = true
+	diff := PeerAllowedIPsDiff{Peer: 1, Before: parsePrefixes(t, "10.0.0.0/24"), After: parsePrefixes(t, "10.0.0.0/25", "192.0.2.1/32")}
+	if err := checkPeerAllowedIPsDiff(&diff, parsePrefixes(t, "10.0.0.128/25")); err == nil || !strings.Contains(err.Error(), "added 192.0.2.1/32 to AllowedIPs 10.0.0.0/24 of peer 2") {
+		t.Errorf("expected gained addresses to fail, got %v", err)
+	}
+	lenTest(t, lines, 1)
+
+	config := &Config{
+		Interface: Interface{WstunnelHost: "10.0.0.1"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "10.0.0.0/24")}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		lenTest(t, gainedPrefixes(config.Peers[0].OriginalAllowedIPs, config.Peers[0].AllowedIPs), 0)
+	}
+}
+
+func TestApplyWstunnelHostExclusionsEndpoint(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "@endpoint, @endpoint:2"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/30"), Endpoint: Endpoint{Host: "vpn.example.com", Port: 51820}},
+			{AllowedIPs: parsePrefixes(t, "198.51.100.0/30"), Endpoint: Endpoint{Host: "198.51.100.2", Port: 51820}},
+			{AllowedIPs: parsePrefixes(t, "203.0.113.0/30")},
+		},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32", "198.51.100.2/32"), excludes)
+	equal(t, parsePrefixes(t, "192.0.2.0/32", "192.0.2.2/31"), config.Peers[0].AllowedIPs)
+	equal(t, parsePrefixes(t, "198.51.100.0/31", "198.51.100.3/32"), config.Peers[1].AllowedIPs)
+
+	for input, want := range map[string]string{
+		"@endpoint:3": "refers to peer 3, which has no endpoint",
+		"@endpoint:4": "refers to peer 4, but there are only 3 peers",
+		"@endpoint:0": "invalid WSTUNNEL_HOST peer number",
+	} {
+		config.Interface.WstunnelHost = input
+		_, err := config.ApplyWstunnelHostExclusions()
+		if !errors.Is(err, ErrWstunnelHostInvalid) || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error containing %q, got %v", input, want, err)
+		}
+	}
+	if _, err := parseWstunnelHostExcludes("@endpoint"); err == nil {
+		t.Error("expected @endpoint without peers to fail")
+	}
+	noError(t, ValidateWstunnelHostSyntax("@endpoint, !@endpoint:2"))
+	noError(t, ValidateWstunnelHostResolvable(context.Background(), "@endpoint:2"))
+	path := filepath.Join(t.TempDir(), "excludes.txt")
+	if err := os.WriteFile(path, []byte("@endpoint:2\n198.51.100.0/24\n"), 0o600); !noError(t, err) {
+		return
+	}
+	noError(t, ValidateWstunnelHostResolvable(context.Background(), "@"+path))
+	if err := ValidateWstunnelHostSyntax("@endpoint:x"); err == nil {
+		t.Error("expected @endpoint:x to be invalid")
+	}
+}
+
+func TestParseWstunnelHostTrailingDot(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	excludes, err := parseWstunnelHostExcludes("vpn.example.com., wss://vpn.example.com.:443/")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+	}
+	_, err = parseWstunnelHostExcludes("missing.example.com.")
+	var hostErr *WstunnelHostError
+	if !errors.As(err, &hostErr) {
+		t.Fatalf("expected WstunnelHostError, got %v", err)
+	}
+	equal(t, "missing.example.com", hostErr.Host)
+	equal(t, `failed to resolve WSTUNNEL_HOST "missing.example.com": no such host`, hostErr.Error())
+}
+
+func ExampleSubtractPrefixes() {
+	base := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")}
+	remove := []netip.Prefix{netip.MustParsePrefix("192.0.2.128/26"), netip.MustParsePrefix("::ffff:192.0.2.0/121")}
+	result, err := SubtractPrefixes(base, remove)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(result)
+	// Output: [192.0.2.192/26 2001:db8::/32]
+}
+
+func ExampleCoalescePrefixes() {
+	fmt.Println(CoalescePrefixes([]netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.0.7/24"),
+		netip.MustParsePrefix("10.0.0.0/25"),
+	}))
+	// Output: [10.0.0.0/23]
+}
+
+func ExampleIntersectPrefixes() {
+	fmt.Println(IntersectPrefixes(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("192.0.2.0/24")},
+	))
+	// Output: [10.1.0.0/16]
+}
+
+func TestWstunnelExcludes(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1", "2001:db8::1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com, 192.0.2.1, 198.51.100.0/24"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")},
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8"), WstunnelHost: "203.0.113.1"},
+		},
+	}
+	excludes, err := config.WstunnelExcludes()
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32", "198.51.100.0/24", "203.0.113.1/32", "2001:db8::1/128"), excludes)
+	}
+	equal(t, parsePrefixes(t, "0.0.0.0/0"), config.Peers[0].AllowedIPs)
+	lenTest(t, config.Peers[0].OriginalAllowedIPs, 0)
+
+	config.Interface.WstunnelHost, config.Peers[1].WstunnelHost = "", ""
+	if excludes, err := config.WstunnelExcludes(); noError(t, err) {
+		lenTest(t, excludes, 0)
+	}
+}
+
+func TestPreviewWstunnelExcludeEffects(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1, 198.51.100.7, 2001:db8::1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/24")},
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8"), WstunnelHost: "10.1.2.3, 192.0.2.2"},
+		},
+	}
+	effects, err := config.PreviewWstunnelExcludeEffects()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, []ExcludeEffect{
+		{netip.MustParsePrefix("10.1.2.3/32"), true},
+		{netip.MustParsePrefix("192.0.2.1/32"), true},
+		{netip.MustParsePrefix("192.0.2.2/32"), false},
+		{netip.MustParsePrefix("198.51.100.7/32"), false},
+		{netip.MustParsePrefix("2001:db8::1/128"), false},
+	}, effects)
+	equal(t, parsePrefixes(t, "192.0.2.0/24"), config.Peers[0].AllowedIPs)
+}
+
+func TestWstunnelBypass(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1", "2001:db8::1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "wss://vpn.example.com:8443, 198.51.100.0/24", WstunnelPort: 8443},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+	}
+	bypass, err := config.WstunnelBypass()
+	if noError(t, err) {
+		equal(t, WstunnelBypass{
+			Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+			Port:  8443,
+		}, bypass)
+	}
+}
+
+func TestParseWstunnelHostDebugLogger(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"203.0.113.5", "2001:db8::5"}})
+	var lines []string
+	DebugLogger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	t.Cleanup(func() { DebugLogger = nil })
+	_, err := parseWstunnelHostExcludes("vpn.example.com, 192.0.2.1:443, 10.0.0.5/8, vpn.example.com/24, !198.51.100.1, missing.example.com")
+	if !errors.Is(err, ErrWstunnelHostUnresolvable) {
+		t.Errorf("expected missing.example.com to fail, got %v", err)
+	}
+	equal(t, []string{
+		`WSTUNNEL_HOST entry "vpn.example.com" resolved to 203.0.113.5, 2001:db8::5`,
+		`WSTUNNEL_HOST entry "192.0.2.1:443" is the address 192.0.2.1`,
+		`WSTUNNEL_HOST entry "10.0.0.5/8" is the prefix 10.0.0.0/8`,
+		`WSTUNNEL_HOST entry "vpn.example.com/24" resolved to 203.0.113.0/24, 2001:d00::/24`,
+		`WSTUNNEL_HOST entry "!198.51.100.1" is the address 198.51.100.1`,
+	}, lines)
+}
+
+func TestSubtractSameFamily(t *testing.T) {
+	v4, v6 := partitionPrefixes(parsePrefixes(t, "2001:db8::/32", "10.0.0.0/8", "::/0", "192.0.2.0/24"))
+	equal(t, parsePrefixes(t, "10.0.0.0/8", "192.0.2.0/24"), v4)
+	equal(t, parsePrefixes(t, "2001:db8::/32", "::/0"), v6)
+
+	equal(t, parsePrefixes(t, "10.0.0.0/9", "192.0.2.0/24"), subtractSameFamily(v4, parsePrefixes(t, "10.128.0.0/9")))
+	equal(t, parsePrefixes(t, "8000::/1"), subtractSameFamily(v6, parsePrefixes(t, "::/1")))
+	equal(t, parsePrefixes(t, "2001:db8:8000::/33"), subtractSameFamily(v6[:1], parsePrefixes(t, "2001:db8::/33")))
+	equal(t, v4, subtractSameFamily(v4, nil))
+}
+
+func TestSplitWstunnelHost(t *testing.T) {
+	tests := []struct {
+		input, host string
+		port        uint16
+	}{
+		{"vpn.example.com", "vpn.example.com", 0},
+		{"vpn.example.com:8443", "vpn.example.com", 8443},
+		{"192.0.2.1:443", "192.0.2.1", 443},
+		{"2001:db8::1", "2001:db8::1", 0},
+		{"[2001:db8::1]", "2001:db8::1", 0},
+		{"[2001:db8::1]:8443", "2001:db8::1", 8443},
+		{"wss://vpn.example.com:443/path", "vpn.example.com", 443},
+		{"https://vpn.example.com", "vpn.example.com", 0},
+		{"ws://192.0.2.1:8080/", "192.0.2.1", 8080},
+		{"HTTP://[2001:db8::1]:80/ws", "2001:db8::1", 80},
+	}
+	for _, tt := range tests {
+		host, port, err := splitWstunnelHost(tt.input)
+		if noError(t, err) {
+			equal(t, tt.host, host)
+			equal(t, tt.port, port)
+		}
+	}
+	for _, input := range []string{"[2001:db8::1", "vpn.example.com:http", "vpn.example.com:65536", "wss:///path", "ftp://vpn.example.com"} {
+		if _, _, err := splitWstunnelHost(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestWstunnelHostPort(t *testing.T) {
+	port, err := wstunnelHostPort("10.0.0.0/8, vpn.example.com, wss://vpn.example.com:8443/ws, 192.0.2.1:443")
+	if noError(t, err) {
+		equal(t, uint16(8443), port)
+	}
+	port, err = wstunnelHostPort("vpn.example.com")
+	if noError(t, err) {
+		equal(t, uint16(0), port)
+	}
+	port, err = wstunnelHostPort("!192.0.2.1:80, auto-subnet:wss://vpn.example.com:8443")
+	if noError(t, err) {
+		equal(t, uint16(8443), port)
+	}
+}
+
+func TestParseWstunnelHostExcludesAllRecords(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1", "192.0.2.2", "2001:db8::1"}})
+	excludes, err := parseWstunnelHostExcludes("wss://vpn.example.com/ws, 198.51.100.0/24")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32", "192.0.2.2/32", "2001:db8::1/128", "198.51.100.0/24"), excludes)
+	}
+}
+
+func TestApplyWstunnelHostExclusionsIPv6(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"2001:db8::1", "192.0.2.1", "2001:db8::1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "vpn.example.com"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0", "::/0")}},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32", "2001:db8::1/128"), excludes)
+	allowed := config.Peers[0].AllowedIPs
+	lenTest(t, allowed, 32+128)
+	for _, p := range allowed {
+		if p.Contains(netip.MustParseAddr("2001:db8::1")) || p.Contains(netip.MustParseAddr("192.0.2.1")) {
+			t.Errorf("%s still routes an excluded address", p)
+		}
+	}
+	contains(t, allowed, netip.MustParsePrefix("2001:db8::/128"))
+	contains(t, allowed, netip.MustParsePrefix("8000::/1"))
+}
+
+func TestPreviewWstunnelHostExclusions(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")},
+			{},
+			{AllowedIPs: parsePrefixes(t, "198.51.100.0/24")},
+		},
+	}
+	diffs, err := config.PreviewWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, []PeerAllowedIPsDiff{
+		{Peer: 0, Before: parsePrefixes(t, "192.0.2.0/31"), After: parsePrefixes(t, "192.0.2.0/32")},
+		{Peer: 2, Before: parsePrefixes(t, "198.51.100.0/24"), After: parsePrefixes(t, "198.51.100.0/24")},
+	}, diffs)
+	equal(t, parsePrefixes(t, "192.0.2.0/31"), config.Peers[0].AllowedIPs)
+}
+
+func TestApplyWstunnelHostExclusionsPartialFailure(t *testing.T) {
+	fakeResolver(t, map[string][]string{"good.example.com": {"192.0.2.1"}})
+	config := &Config{
+		Interface: Interface{WstunnelHost: "good.example.com, bad.example.com"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")}},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if !errors.Is(err, errFakeNoSuchHost) {
+		t.Errorf("expected joined lookup error, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+	equal(t, parsePrefixes(t, "192.0.2.0/32"), config.Peers[0].AllowedIPs)
+
+	config.Interface.WstunnelHost = "bad.example.com"
+	excludes, err = config.ApplyWstunnelHostExclusions()
+	if err == nil || len(excludes) != 0 {
+		t.Errorf("expected failure with no excludes, got %v, %v", excludes, err)
+	}
+}
+
+func TestWstunnelUnresolvablePolicy(t *testing.T) {
+	fakeResolver(t, map[string][]string{"good.example.com": {"192.0.2.1"}, "edge1.example.com": {"192.0.2.1"}})
+	defer func(old UnresolvableWstunnelHostPolicy) { WstunnelUnresolvablePolicy = old }(WstunnelUnresolvablePolicy)
+	config := &Config{
+		Interface: Interface{WstunnelHost: "good.example.com, bad.example.com"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")}},
+	}
+	WstunnelUnresolvablePolicy = SkipUnresolvableWstunnelHost
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+		equal(t, parsePrefixes(t, "192.0.2.0/32"), config.Peers[0].AllowedIPs)
+	}
+	_, err = parseWstunnelHostExcludes("good.example.com, 10.0.0.1/33")
+	if !errors.Is(err, ErrWstunnelHostInvalid) {
+		t.Errorf("expected invalid entries to still fail, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "excludes.txt")
+	if err := os.WriteFile(path, []byte("good.example.com\nbad.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, partial := range []string{"edge{1..2}.example.com", "@" + path} {
+		if excludes, err := parseWstunnelHostExcludes(partial); noError(t, err) {
+			equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+		}
+	}
+
+	WstunnelUnresolvablePolicy = SkipAllUnresolvableWstunnelHost
+	excludes, err = config.ApplyWstunnelHostExclusions()
+	if noError(t, err) {
+		lenTest(t, excludes, 0)
+		equal(t, parsePrefixes(t, "192.0.2.0/31"), config.Peers[0].AllowedIPs)
+	}
+}
+
+func TestApplyWstunnelHostExclusionsRejectsEmptying(t *testing.T) {
+	defer func(old EmptiedAllowedIPsPolicy) { EmptiedAllowedIPs = old }(EmptiedAllowedIPs)
+	EmptiedAllowedIPs = RejectEmptiedAllowedIPs
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1, 0.0.0.0/0"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "::/0")},
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8", "192.168.0.0/16")},
+		},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if err == nil || !strings.Contains(err.Error(), "peer 2") || !strings.Contains(err.Error(), "0.0.0.0/0") {
+		t.Errorf("expected error naming peer 2 and 0.0.0.0/0, got %v", err)
+	}
+	lenTest(t, excludes, 0)
+	equal(t, parsePrefixes(t, "10.0.0.0/8", "192.168.0.0/16"), config.Peers[1].AllowedIPs)
+}
+
+func TestApplyWstunnelHostExclusionsEmptiedPolicy(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		if strings.HasPrefix(format, "Warning:") {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}
+	}
+	defer func(old EmptiedAllowedIPsPolicy) { EmptiedAllowedIPs = old }(EmptiedAllowedIPs)
+	newConfig := func() *Config {
+		return &Config{
+			Interface: Interface{WstunnelHost: "192.0.2.1"},
+			Peers: []Peer{
+				{AllowedIPs: parsePrefixes(t, "192.0.2.1/32")},
+				{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")},
+			},
+		}
+	}
+
+	config := newConfig()
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		lenTest(t, config.Peers[0].AllowedIPs, 0)
+		equal(t, []string{"Warning: WSTUNNEL_HOST excludes 192.0.2.1/32 remove all AllowedIPs of peer 1, so it no longer routes any traffic"}, lines)
+	}
+
+	EmptiedAllowedIPs = SkipEmptiedAllowedIPs
+	config, lines = newConfig(), nil
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32"), config.Peers[0].AllowedIPs)
+		equal(t, parsePrefixes(t, "192.0.2.0/32"), config.Peers[1].AllowedIPs)
+		equal(t, []string{"Warning: WSTUNNEL_HOST excludes 192.0.2.1/32 remove all AllowedIPs of peer 1, so its AllowedIPs are left unchanged"}, lines)
+	}
+
+	EmptiedAllowedIPs = AllowEmptiedAllowedIPs
+	config, lines = newConfig(), nil
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		lenTest(t, config.Peers[0].AllowedIPs, 0)
+		equal(t, parsePrefixes(t, "192.0.2.1/32"), config.Peers[0].OriginalAllowedIPs)
+		equal(t, []string{"Warning: WSTUNNEL_HOST excludes 192.0.2.1/32 remove all AllowedIPs of peer 1, so it no longer routes any traffic"}, lines)
+	}
+
+	EmptiedAllowedIPs = RejectEmptiedAllowedIPs
+	config, lines = newConfig(), nil
+	if _, err := config.ApplyWstunnelHostExclusions(); err == nil || !strings.Contains(err.Error(), "remove all AllowedIPs of peer 1") {
+		t.Errorf("expected emptied peer 1 to fail, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32"), config.Peers[0].AllowedIPs)
+	lenTest(t, lines, 0)
+}
+
+func TestUnionPrefixList(t *testing.T) {
+	fragments, err := subtractPrefixList(parsePrefixes(t, "10.0.0.0/8", "2001:db8::/32"), parsePrefixes(t, "10.1.2.3/32", "2001:db8::1/128"))
+	noError(t, err)
+	equal(t, parsePrefixes(t, "10.0.0.0/8", "2001:db8::/32"), unionPrefixList(fragments, parsePrefixes(t, "2001:db8::1/128", "10.1.2.3/32")))
+	equal(t, parsePrefixes(t, "10.0.0.0/8", "192.168.0.0/24"), unionPrefixList(parsePrefixes(t, "10.1.0.0/16", "192.168.0.0/25"), parsePrefixes(t, "192.168.0.128/25", "10.0.0.0/8", "10.2.0.0/16")))
+}
+
+func TestRestoreWstunnelHostExclusions(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelHost: "10.1.2.2, 10.1.2.3, 2001:db8::1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "10.0.0.0/8")},
+			{AllowedIPs: parsePrefixes(t, "2001:db8::/32")},
+			{AllowedIPs: parsePrefixes(t, "192.168.0.0/24")},
+		},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	config.RestoreWstunnelHostExclusions(excludes)
+	equal(t, parsePrefixes(t, "10.0.0.0/8"), config.Peers[0].AllowedIPs)
+	equal(t, parsePrefixes(t, "2001:db8::/32"), config.Peers[1].AllowedIPs)
+	equal(t, parsePrefixes(t, "192.168.0.0/24"), config.Peers[2].AllowedIPs)
+}
+
+func TestIntersectPrefixList(t *testing.T) {
+	a := parsePrefixes(t, "10.0.0.0/8", "192.168.0.0/24", "::/0")
+	b := parsePrefixes(t, "10.1.2.3/32", "10.1.2.2/32", "0.0.0.0/0", "2001:db8::1/128", "172.16.0.0/12")
+	equal(t, parsePrefixes(t, "10.0.0.0/8", "192.168.0.0/24", "2001:db8::1/128"), intersectPrefixList(a, b))
+	equal(t, parsePrefixes(t, "10.1.2.2/31"), intersectPrefixList(a[:1], b[:2]))
+	lenTest(t, intersectPrefixList(parsePrefixes(t, "10.0.0.0/8"), parsePrefixes(t, "::/0", "11.0.0.0/8")), 0)
+}
+
+func TestSubtractPrefix(t *testing.T) {
+	tests := []struct {
+		base, remove string
+		expected     []string
+	}{
+		{"10.128.0.0/9", "10.0.0.0/8", nil},
+		{"10.0.0.0/9", "10.0.0.0/8", nil},
+		{"10.0.0.0/8", "10.0.0.0/8", nil},
+		{"10.0.0.0/8", "0.0.0.0/0", nil},
+		{"10.0.0.0/8", "11.0.0.0/8", []string{"10.0.0.0/8"}},
+		{"10.0.0.0/8", "10.0.0.0/9", []string{"10.128.0.0/9"}},
+		{"10.0.0.0/8", "10.128.0.0/9", []string{"10.0.0.0/9"}},
+		{"10.0.0.0/8", "10.64.0.0/10", []string{"10.0.0.0/10", "10.128.0.0/9"}},
+		{"10.0.0.0/8", "10.191.0.0/16", []string{"10.0.0.0/9", "10.128.0.0/11", "10.160.0.0/12", "10.176.0.0/13", "10.184.0.0/14", "10.188.0.0/15", "10.190.0.0/16", "10.192.0.0/10"}},
+		{"2001:db8::/32", "2001::/16", nil},
+		{"2001:db8::/32", "2001:db8:8000::/33", []string{"2001:db8::/33"}},
+		{"192.0.2.1/32", "192.0.2.1/32", nil},
+		{"192.0.2.1/32", "192.0.2.2/32", []string{"192.0.2.1/32"}},
+		{"192.0.2.1/32", "192.0.2.0/31", nil},
+		{"192.0.2.0/31", "192.0.2.0/32", []string{"192.0.2.1/32"}},
+		{"192.0.2.0/31", "192.0.2.1/32", []string{"192.0.2.0/32"}},
+		{"192.0.2.0/31", "192.0.2.2/32", []string{"192.0.2.0/31"}},
+		{"192.0.2.0/31", "192.0.2.0/31", nil},
+		{"2001:db8::1/128", "2001:db8::1/128", nil},
+		{"2001:db8::1/128", "2001:db8::2/128", []string{"2001:db8::1/128"}},
+		{"2001:db8::1/128", "2001:db8::/127", nil},
+		{"2001:db8::/127", "2001:db8::/128", []string{"2001:db8::1/128"}},
+		{"2001:db8::/127", "2001:db8::1/128", []string{"2001:db8::/128"}},
+		{"2001:db8::/127", "2001:db8::2/128", []string{"2001:db8::/127"}},
+		{"192.168.0.0/23", "192.168.0.128/25", []string{"192.168.0.0/25", "192.168.1.0/24"}},
+		{"192.168.0.0/23", "192.168.1.128/25", []string{"192.168.0.0/24", "192.168.1.0/25"}},
+		{"192.168.0.0/23", "192.168.0.0/24", []string{"192.168.1.0/24"}},
+		{"192.168.0.0/23", "192.168.1.0/24", []string{"192.168.0.0/24"}},
+		{"192.168.0.0/23", "192.168.0.0/23", nil},
+		{"192.168.0.0/23", "192.168.1.5/22", nil},
+	}
+	for _, tt := range tests {
+		actual := subtractPrefix(netip.MustParsePrefix(tt.base), netip.MustParsePrefix(tt.remove))
+		sortPrefixes(actual)
+		var actualStrings []string
+		for _, p := range actual {
+			actualStrings = append(actualStrings, p.String())
+		}
+		equal(t, tt.expected, actualStrings)
+	}
+}
+
+func TestSubtractPrefixDepth(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	for _, tt := range []struct{ base, addr string }{
+		{"0.0.0.0/0", "203.0.113.77"},
+		{"10.0.0.0/8", "10.255.255.255"},
+		{"::/0", "2001:db8::1"},
+		{"2001:db8::/32", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+	} {
+		base, addr := netip.MustParsePrefix(tt.base), netip.MustParseAddr(tt.addr)
+		for bits := base.Bits(); bits <= addr.BitLen(); bits++ {
+			remove := netip.PrefixFrom(addr, bits).Masked()
+			// Recursing takes remove.Bits()-base.Bits() levels, so starting
+			// that much below the limit must still succeed.
+			start := addr.BitLen() - (bits - base.Bits())
+			equal(t, subtractPrefix(base, remove), subtractPrefixDepth(base, remove, start))
+			// One level less and the deepest call hits the limit, keeping
+			// the addresses it was to remove.
+			if got := subtractPrefixDepth(base, remove, start+1); prefixListAddressCount(got).Cmp(prefixListAddressCount(subtractPrefix(base, remove))) <= 0 {
+				t.Errorf("subtracting %s from %s with depth %d = %v, want the limit to keep part of %s", remove, base, start+1, got, remove)
+			}
+		}
+	}
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "Internal error:") {
+		t.Errorf("expected an internal error to be logged, got %q", lines)
+	}
+}
+
+func TestSubtractPrefixListRejectsInvalid(t *testing.T) {
+	bad := netip.PrefixFrom(netip.MustParseAddr("10.0.0.0"), 33)
+	if _, err := subtractPrefixList([]netip.Prefix{bad}, parsePrefixes(t, "10.0.0.1/32")); err == nil {
+		t.Error("expected error for invalid base prefix")
+	}
+	if _, err := subtractPrefixList(parsePrefixes(t, "10.0.0.0/8"), []netip.Prefix{bad}); err == nil {
+		t.Error("expected error for invalid remove prefix")
+	}
+	if _, _, ok := splitPrefix(netip.MustParsePrefix("10.0.0.1/32")); ok {
+		t.Error("split of a host prefix should fail")
+	}
+	if _, _, ok := splitPrefix(bad); ok {
+		t.Error("split of an invalid prefix should fail")
+	}
+}
+
+func TestSubtractPrefixListUnmaps(t *testing.T) {
+	actual, err := subtractPrefixList(parsePrefixes(t, "::ffff:10.0.0.0/104", "::fffe:0:0/95"), parsePrefixes(t, "10.0.0.0/9"))
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "10.128.0.0/9", "::fffe:0:0/95"), actual)
+	}
+	actual, err = subtractPrefixList(parsePrefixes(t, "10.0.0.0/8"), parsePrefixes(t, "::ffff:10.128.0.0/105"))
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "10.0.0.0/9"), actual)
+	}
+}
+
+func TestAddressesRemoved(t *testing.T) {
+	before := parsePrefixes(t, "10.0.0.0/8", "10.1.0.0/16", "::/0")
+	after, err := subtractPrefixList(before, parsePrefixes(t, "10.1.2.3/32", "10.1.2.4/31", "2001:db8::/64"))
+	if !noError(t, err) {
+		return
+	}
+	equal(t, "18446744073709551619", addressesRemoved(before, after).String())
+	equal(t, "0", addressesRemoved(before, before).String())
+}
+
+func TestApplyWstunnelHostExclusionsLogger(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, []string{
+		"WSTUNNEL_HOST excludes: 192.0.2.1/32",
+		"AllowedIPs updated for peer 1: 192.0.2.0/31 -> 192.0.2.0/32",
+		"WSTUNNEL_HOST excluded 1 prefix(es) totaling 1 address(es) from 1 peer(s)",
+	}, lines)
+}
+
+func TestOnExclusionApplied(t *testing.T) {
+	defer func() { OnExclusionApplied = nil }()
+	var events []PeerAllowedIPsDiff
+	OnExclusionApplied = func(peerIndex int, before, after []netip.Prefix) {
+		events = append(events, PeerAllowedIPsDiff{peerIndex, before, after})
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "198.51.100.0/24")},
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")},
+		},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, []PeerAllowedIPsDiff{{1, parsePrefixes(t, "192.0.2.0/31"), parsePrefixes(t, "192.0.2.0/32")}}, events)
+}
+
+func TestApplyWstunnelHostExclusionsStream(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "198.51.100.0/24")},
+			{},
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/31")},
+		},
+	}
+	var events []PeerAllowedIPsDiff
+	excludes, err := config.ApplyWstunnelHostExclusionsStream(func(peerIndex int, before, after []netip.Prefix) {
+		events = append(events, PeerAllowedIPsDiff{peerIndex, before, after})
+	})
+	if !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+	equal(t, []PeerAllowedIPsDiff{
+		{0, parsePrefixes(t, "198.51.100.0/24"), parsePrefixes(t, "198.51.100.0/24")},
+		{2, parsePrefixes(t, "192.0.2.0/31"), parsePrefixes(t, "192.0.2.0/32")},
+	}, events)
+	equal(t, parsePrefixes(t, "192.0.2.0/32"), config.Peers[2].AllowedIPs)
+	equal(t, parsePrefixes(t, "192.0.2.0/31"), config.Peers[2].OriginalAllowedIPs)
+
+	defer func(old EmptiedAllowedIPsPolicy) { EmptiedAllowedIPs = old }(EmptiedAllowedIPs)
+	EmptiedAllowedIPs = RejectEmptiedAllowedIPs
+	config.Peers = append(config.Peers, Peer{AllowedIPs: parsePrefixes(t, "192.0.2.1/32")})
+	events = nil
+	_, err = config.ApplyWstunnelHostExclusionsStream(func(peerIndex int, before, after []netip.Prefix) {
+		events = append(events, PeerAllowedIPsDiff{peerIndex, before, after})
+	})
+	if err == nil || !strings.Contains(err.Error(), "remove all AllowedIPs of peer 4") {
+		t.Errorf("expected emptied peer 4 to fail, got %v", err)
+	}
+	lenTest(t, events, 2)
+}
+
+func TestResetWstunnelHostExclusions(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "192.0.2.0/24")},
+			{},
+		},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.0/24"), config.Peers[0].OriginalAllowedIPs)
+	lenTest(t, config.Peers[1].OriginalAllowedIPs, 0)
+	config.ResetWstunnelHostExclusions()
+	equal(t, parsePrefixes(t, "192.0.2.0/24"), config.Peers[0].AllowedIPs)
+	lenTest(t, config.Peers[0].OriginalAllowedIPs, 0)
+	lenTest(t, config.Peers[1].AllowedIPs, 0)
+}
+
+func TestApplyWstunnelHostExclusionsIdempotent(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/30")}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+			return
+		}
+		equal(t, parsePrefixes(t, "192.0.2.0/32", "192.0.2.2/31"), config.Peers[0].AllowedIPs)
+	}
+	config.Interface.WstunnelHost = "192.0.2.2"
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.0/31", "192.0.2.3/32"), config.Peers[0].AllowedIPs)
+	config.Interface.WstunnelHost = ""
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.0/30"), config.Peers[0].AllowedIPs)
+}
+
+func TestCheckWstunnelLocalPort(t *testing.T) {
+	config := &Config{
+		Interface: Interface{WstunnelLocalPort: 51820},
+		Peers: []Peer{
+			{Endpoint: Endpoint{"127.0.0.1", 51820}},
+			{Endpoint: Endpoint{"localhost", 51820}},
+			{Endpoint: Endpoint{"::1", 51820}},
+			{},
+		},
+	}
+	if !config.CheckWstunnelLocalPort() {
+		t.Error("loopback endpoints on the local port should pass")
+	}
+	config.Peers = append(config.Peers, Peer{Endpoint: Endpoint{"127.0.0.1", 51821}})
+	if config.CheckWstunnelLocalPort() {
+		t.Error("endpoint on another port should fail")
+	}
+	config.Peers[len(config.Peers)-1].Endpoint = Endpoint{"192.0.2.1", 51820}
+	if config.CheckWstunnelLocalPort() {
+		t.Error("non-loopback endpoint should fail")
+	}
+	config.Interface.WstunnelLocalPort = 0
+	if !config.CheckWstunnelLocalPort() {
+		t.Error("unset local port should not be checked")
+	}
+}
+
+func TestExcludesWithoutEndpoint(t *testing.T) {
+	config := &Config{
+		Peers: []Peer{
+			{Endpoint: Endpoint{"192.0.2.1", 443}},
+			{Endpoint: Endpoint{"127.0.0.1", 51820}},
+			{Endpoint: Endpoint{"2001:db8::1", 443}},
+		},
+	}
+	excludes := parsePrefixes(t, "192.0.2.1/32", "198.51.100.0/24", "2001:db8::/64", "2001:db8::2/128")
+	equal(t, parsePrefixes(t, "198.51.100.0/24", "2001:db8::2/128"), config.excludesWithoutEndpoint(excludes))
+
+	config.Peers = config.Peers[1:2]
+	lenTest(t, config.excludesWithoutEndpoint(excludes), 0)
+}
+
+func TestFindOverlappingAllowedIPs(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var warnings int
+	Logger = func(format string, args ...any) {
+		if strings.Contains(format, "are routed by both") {
+			warnings++
+		}
+	}
+	defer func(old bool) { WarnOverlappingAllowedIPs = old }(WarnOverlappingAllowedIPs)
+	newConfig := func() *Config {
+		return &Config{
+			Interface: Interface{WstunnelHost: "10.1.2.3"},
+			Peers: []Peer{
+				{AllowedIPs: parsePrefixes(t, "10.0.0.0/8")},
+				{AllowedIPs: parsePrefixes(t, "10.1.2.0/24", "192.168.0.0/16")},
+				{AllowedIPs: parsePrefixes(t, "192.168.1.0/24", "172.16.0.0/12")},
+			},
+		}
+	}
+	WarnOverlappingAllowedIPs = false
+	if _, err := newConfig().ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, 0, warnings)
+
+	WarnOverlappingAllowedIPs = true
+	config := newConfig()
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, 9, warnings)
+	equal(t, []Overlap{
+		{0, 1, netip.MustParsePrefix("10.1.2.0/31")},
+		{0, 1, netip.MustParsePrefix("10.1.2.2/32")},
+		{0, 1, netip.MustParsePrefix("10.1.2.4/30")},
+		{0, 1, netip.MustParsePrefix("10.1.2.8/29")},
+		{0, 1, netip.MustParsePrefix("10.1.2.16/28")},
+		{0, 1, netip.MustParsePrefix("10.1.2.32/27")},
+		{0, 1, netip.MustParsePrefix("10.1.2.64/26")},
+		{0, 1, netip.MustParsePrefix("10.1.2.128/25")},
+		{1, 2, netip.MustParsePrefix("192.168.1.0/24")},
+	}, config.FindOverlappingAllowedIPs())
+	config.Peers = config.Peers[2:]
+	lenTest(t, config.FindOverlappingAllowedIPs(), 0)
+}
+
+func TestAllowedIPsDelta(t *testing.T) {
+	before := &Config{Peers: []Peer{
+		{AllowedIPs: parsePrefixes(t, "0.0.0.0/1", "128.0.0.0/1")},
+		{AllowedIPs: parsePrefixes(t, "10.0.0.0/8", "2001:db8::/32")},
+	}}
+	after := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1, 10.1.2.3"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")},
+			{AllowedIPs: parsePrefixes(t, "fd00::/8")},
+		},
+	}
+	if _, err := after.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	added, removed := AllowedIPsDelta(before, after)
+	equal(t, "fd00::/8", prefixListToString(added))
+	equal(t, "10.1.2.3/32, 192.0.2.1/32, 2001:db8::/32", prefixListToString(removed))
+	added, removed = AllowedIPsDelta(after, after)
+	lenTest(t, added, 0)
+	lenTest(t, removed, 0)
+}
+
+func TestDeriveEndpointExcludes(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1", "2001:db8::1"}})
+	config := &Config{
+		Peers: []Peer{
+			{Endpoint: Endpoint{"vpn.example.com", 443}},
+			{Endpoint: Endpoint{"198.51.100.7", 51820}},
+			{Endpoint: Endpoint{"127.0.0.1", 51820}},
+			{Endpoint: Endpoint{"192.0.2.1", 443}},
+			{},
+		},
+	}
+	excludes, err := config.DeriveEndpointExcludes()
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32", "198.51.100.7/32", "2001:db8::1/128"), excludes)
+	}
+	config.Peers = append(config.Peers, Peer{Endpoint: Endpoint{"bad.example.com", 443}})
+	excludes, err = config.DeriveEndpointExcludes()
+	if err == nil || !strings.Contains(err.Error(), "peer 6") {
+		t.Errorf("expected error naming peer 6, got %v", err)
+	}
+	lenTest(t, excludes, 3)
+}
+
+func TestSplitCommaList(t *testing.T) {
+	for _, input := range []string{"a,b", "a,,b", "a,b,", ", a , ,b"} {
+		parts, err := splitCommaList(input)
+		if noError(t, err) {
+			equal(t, []string{"a", "b"}, parts)
+		}
+	}
+	for _, input := range []string{"", " ", ",", " , ,"} {
+		if _, err := splitCommaList(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestParseWstunnelHostHostnameMask(t *testing.T) {
+	fakeResolver(t, map[string][]string{"edge.example.com": {"192.0.2.77", "2001:db8::1"}})
+	excludes, err := parseWstunnelHostExcludes("edge.example.com/24")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.0/24", "2001:d00::/24"), excludes)
+	}
+	if _, err := parseWstunnelHostExcludes("edge.example.com/64"); err == nil {
+		t.Error("expected error for /64 applied to an IPv4 address")
+	}
+	for _, input := range []string{"edge.example.com/", "edge.example.com/x", "/24", "10.0.0.1/33"} {
+		if _, err := parseWstunnelHostExcludes(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestApplyWstunnelHostExclusionsNoOverlap(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	allowed := parsePrefixes(t, "192.168.0.0/16", "10.0.0.0/8", "10.1.0.0/16")
+	config := &Config{
+		Interface: Interface{WstunnelHost: "198.51.100.7"},
+		Peers:     []Peer{{AllowedIPs: allowed}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.168.0.0/16", "10.0.0.0/8", "10.1.0.0/16"), config.Peers[0].AllowedIPs)
+	equal(t, []string{
+		"WSTUNNEL_HOST excludes: 198.51.100.7/32",
+		"WSTUNNEL_HOST excluded 1 prefix(es) totaling 0 address(es) from 0 peer(s)",
+	}, lines)
+}
+
+func TestSubtractPrefixListPreservesDisjoint(t *testing.T) {
+	disjoint := parsePrefixes(t, "10.0.0.0/8", "172.16.0.0/12", "198.51.100.0/24", "2001:db8::/32", "fd00::/8")
+	for _, remove := range [][]netip.Prefix{
+		parsePrefixes(t, "192.0.2.1/32", "2001:db9::1/128"),
+		parsePrefixes(t, "0.0.0.0/32"),
+		nil,
+	} {
+		after, err := subtractPrefixList(disjoint, remove)
+		if !noError(t, err) {
+			continue
+		}
+		lenTest(t, after, len(disjoint))
+		for i := range after {
+			if i < len(disjoint) && (after[i] != disjoint[i] || after[i] != disjoint[i].Masked()) {
+				t.Errorf("AllowedIPs %d changed from %v to %v when removing %v", i, disjoint[i], after[i], remove)
+			}
+		}
+	}
+	after, err := subtractPrefixList(append(parsePrefixes(t, "192.0.2.0/31"), disjoint...), parsePrefixes(t, "192.0.2.1/32"))
+	if noError(t, err) {
+		equal(t, "10.0.0.0/8, 172.16.0.0/12, 192.0.2.0/32, 198.51.100.0/24, 2001:db8::/32, fd00::/8", prefixListToString(after))
+	}
+}
+
+func TestParseWstunnelHostUnalignedPrefix(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	excludes, err := parseWstunnelHostExcludes("10.0.0.5/24, 10.1.0.0/24")
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "10.0.0.0/24", "10.1.0.0/24"), excludes)
+	}
+	equal(t, []string{"WSTUNNEL_HOST entry 10.0.0.5/24 has host bits set, so it is interpreted as the network 10.0.0.0/24"}, lines)
+}
+
+func TestApplyWstunnelHostExclusionsFamilyMismatch(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "2001:db8::1, 192.0.2.1"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	want := "WSTUNNEL_HOST excludes 2001:db8::1/128 have no effect, since no peer AllowedIPs are of that address family"
+	found := false
+	for _, line := range lines {
+		found = found || line == want
+		if strings.Contains(line, "192.0.2.1/32 have no effect") {
+			t.Errorf("unexpected note: %s", line)
+		}
+	}
+	if !found {
+		t.Errorf("missing %q in %q", want, lines)
+	}
+}
+
+func TestWstunnelExcludeDefaultRouteOnly(t *testing.T) {
+	defer func(old bool) { WstunnelExcludeDefaultRouteOnly = old }(WstunnelExcludeDefaultRouteOnly)
+	WstunnelExcludeDefaultRouteOnly = true
+	config := &Config{
+		Interface: Interface{WstunnelHost: "10.1.2.3, 2001:db8::1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "10.1.0.0/16")},
+			{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")},
+			{AllowedIPs: parsePrefixes(t, "::/0", "10.1.2.0/24")},
+		},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "10.1.0.0/16"), config.Peers[0].AllowedIPs)
+	lenTest(t, overlappingPrefixes(parsePrefixes(t, "10.1.2.3/32"), config.Peers[1].AllowedIPs), 0)
+	lenTest(t, overlappingPrefixes(parsePrefixes(t, "10.1.2.3/32", "2001:db8::1/128"), config.Peers[2].AllowedIPs), 0)
+
+	if _, err := config.ApplyExclusions(parsePrefixes(t, "10.1.0.0/17")); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "10.1.128.0/17"), config.Peers[0].AllowedIPs)
+	lenTest(t, overlappingPrefixes(parsePrefixes(t, "10.1.0.0/17", "10.1.2.3/32"), config.Peers[1].AllowedIPs), 0)
+}
+
+func TestApplyExclusionsDNSWithoutWstunnelHost(t *testing.T) {
+	config := &Config{
+		Interface: Interface{
+			DNS:                []netip.Addr{netip.MustParseAddr("10.0.0.53")},
+			WstunnelExcludeDNS: true,
+		},
+		Peers: []Peer{{AllowedIPs: parsePrefixes(t, "10.0.0.0/24")}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		equal(t, parsePrefixes(t, "10.0.0.0/24"), config.Peers[0].AllowedIPs)
+	}
+	if _, err := config.ApplyExclusions(parsePrefixes(t, "10.0.0.128/25")); !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "10.0.0.0/27", "10.0.0.32/28", "10.0.0.48/30", "10.0.0.52/32", "10.0.0.54/31", "10.0.0.56/29", "10.0.0.64/26"), config.Peers[0].AllowedIPs)
+}
+
+func TestApplyExclusions(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "0.0.0.0/0"), Endpoint: Endpoint{Host: "192.0.2.1", Port: 443}},
+			{AllowedIPs: parsePrefixes(t, "198.51.100.0/23"), WstunnelHost: "203.0.113.1"},
+		},
+	}
+	excludes, err := config.ApplyExclusions(parsePrefixes(t, "198.51.100.7/24", "::ffff:198.51.100.0/120"))
+	if !noError(t, err) {
+		return
+	}
+	equal(t, parsePrefixes(t, "192.0.2.1/32", "198.51.100.0/24", "203.0.113.1/32"), excludes)
+	for _, addr := range []string{"192.0.2.1", "198.51.100.1"} {
+		if _, ok := config.RoutesAddr(netip.MustParseAddr(addr)); ok {
+			t.Errorf("%s is still routed", addr)
+		}
+	}
+	equal(t, parsePrefixes(t, "198.51.101.0/24"), config.Peers[1].AllowedIPs)
+	found := false
+	for _, line := range lines {
+		found = found || line == "WSTUNNEL_HOST and extra excludes: 192.0.2.1/32, 198.51.100.0/24, 203.0.113.1/32"
+		if strings.Contains(line, "198.51.100.0/24 do not match") {
+			t.Errorf("unexpected endpoint warning: %s", line)
+		}
+	}
+	if !found {
+		t.Errorf("missing combined excludes in %q", lines)
+	}
+
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		equal(t, parsePrefixes(t, "198.51.100.0/23"), config.Peers[1].AllowedIPs)
+	}
+	if _, err := config.ApplyExclusions([]netip.Prefix{{}}); err == nil {
+		t.Error("invalid extra exclude accepted")
+	}
+}
+
+func TestApplyWstunnelHostExclusionsNoAllowedIPs(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "2001:db8::1, 192.0.2.1"},
+		Peers:     []Peer{{}, {}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	want := "WSTUNNEL_HOST is set, but no peer has AllowedIPs to exclude it from, so the configuration may be incomplete"
+	count := 0
+	for _, line := range lines {
+		if line == want {
+			count++
+		}
+		if strings.Contains(line, "have no effect") {
+			t.Errorf("unexpected note: %s", line)
+		}
+	}
+	equal(t, 1, count)
+}
+
+func TestApplyWstunnelHostExclusionsFamilies(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	defer func(old AddressFamilies) { WstunnelExcludeFamilies = old }(WstunnelExcludeFamilies)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	WstunnelExcludeFamilies = FamilyIPv4
+	config := &Config{
+		Interface: Interface{WstunnelHost: "192.0.2.1, 2001:db8::1"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "192.0.2.0/31", "2001:db8::/127")}},
+	}
+	excludes, err := config.ApplyWstunnelHostExclusions()
+	if !noError(t, err) {
+		return
+	}
+	equal(t, "192.0.2.1/32", prefixListToString(excludes))
+	equal(t, "192.0.2.0/32, 2001:db8::/127", prefixListToString(config.Peers[0].AllowedIPs))
+	for _, want := range []string{
+		"WSTUNNEL_HOST excludes 2001:db8::1/128 are of an address family that is not processed, so they are ignored",
+		"WSTUNNEL_HOST excludes are IPv4 only, so IPv6 AllowedIPs are unaffected",
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("missing %q in %q", want, lines)
+		}
+	}
+}
+
+func TestApplyWstunnelHostExclusionsFragmentWarning(t *testing.T) {
+	defer func(old func(string, ...any)) { Logger = old }(Logger)
+	var lines []string
+	Logger = func(format string, args ...any) {
+		if strings.HasPrefix(format, "Warning:") {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}
+	}
+	config := &Config{
+		Interface: Interface{WstunnelHost: "10.1.2.3, 2001:db8::1"},
+		Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "10.0.0.0/8", "2001:db8::/32")}},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		equal(t, []string{"Warning: WSTUNNEL_HOST exclusions split AllowedIPs 2001:db8::/32 of peer 1 into 96 prefixes"}, lines)
+	}
+
+	defer func(old int) { FragmentWarningThreshold = old }(FragmentWarningThreshold)
+	FragmentWarningThreshold = 0
+	lines = nil
+	if _, err := config.ApplyWstunnelHostExclusions(); noError(t, err) {
+		lenTest(t, lines, 0)
+	}
+}
+
+func TestMaxAllowedIPsAfterExclusion(t *testing.T) {
+	defer func(old int) { MaxAllowedIPsAfterExclusion = old }(MaxAllowedIPsAfterExclusion)
+	MaxAllowedIPsAfterExclusion = 64
+	config := &Config{
+		Interface: Interface{WstunnelHost: "10.1.2.3"},
+		Peers: []Peer{
+			{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")},
+			{AllowedIPs: parsePrefixes(t, "::/0")},
+		},
+	}
+	if _, err := config.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	lenTest(t, config.Peers[0].AllowedIPs, 32)
+
+	config.Interface.WstunnelHost = "10.1.2.3, 2001:db8::1"
+	_, err := config.ApplyWstunnelHostExclusions()
+	if err == nil || err.Error() != "WSTUNNEL_HOST exclusions leave peer 2 with 128 AllowedIPs, more than the limit of 64" {
+		t.Errorf("expected limit error, got %v", err)
+	}
+	equal(t, parsePrefixes(t, "::/0"), config.Peers[1].AllowedIPs)
+}
+
+func TestFormatExclusionReport(t *testing.T) {
+	diffs := []PeerAllowedIPsDiff{
+		{0, parsePrefixes(t, "192.0.2.0/30", "2001:db8::/127"), parsePrefixes(t, "192.0.2.0/32", "192.0.2.2/31", "2001:db8::/128")},
+		{1, parsePrefixes(t, "10.0.0.0/8"), parsePrefixes(t, "10.0.0.0/8")},
+		{2, parsePrefixes(t, "192.0.2.1/32"), nil},
+	}
+	equal(t, "WSTUNNEL_HOST excludes 192.0.2.1/32, 2001:db8::1/128\n"+
+		"Peer 1: 192.0.2.0/30, 2001:db8::/127\n"+
+		"    192.0.2.0/32, 192.0.2.2/31, 2001:db8::/128\n"+
+		"Peer 3: 192.0.2.1/32\n"+
+		"    (none)", formatExclusionReport(diffs))
+	equal(t, "WSTUNNEL_HOST excludes changed no AllowedIPs", formatExclusionReport(diffs[1:2]))
+}
+
+func TestPrefixListAddressCount(t *testing.T) {
+	count := prefixListAddressCount(parsePrefixes(t, "10.0.0.0/8", "192.168.0.1/32", "2001:db8::/127"))
+	equal(t, "16777219", count.String())
+	equal(t, "16777219", FormatAddressCount(count))
+	equal(t, "2^96", FormatAddressCount(prefixListAddressCount(parsePrefixes(t, "2001:db8::/32"))))
+	equal(t, "2^128", FormatAddressCount(prefixListAddressCount(parsePrefixes(t, "::/0"))))
+	equal(t, "1.19e+29", FormatAddressCount(prefixListAddressCount(parsePrefixes(t, "2001:db8::/32", "2001:db9::/33"))))
+	equal(t, "0", FormatAddressCount(prefixListAddressCount(nil)))
+}
+
+func TestParseWstunnelHostExcludesEntryIndex(t *testing.T) {
+	fakeResolver(t, nil)
+	_, err := parseWstunnelHostExcludes("192.0.2.1,\t, 10.0.0.0/8, -")
+	if err == nil || !strings.Contains(err.Error(), "entry 3 of 3") || !strings.Contains(err.Error(), `"-"`) {
+		t.Errorf("expected error naming entry 3, got %v", err)
+	}
+}
+
+// fuzzPrefixLists decodes data into base and remove lists. Each prefix starts
+// with an op byte whose low bit picks the list and whose next bit picks IPv6;
+// when the remaining bits are a multiple of four, the prefix is the previous
+// base prefix lengthened by the next byte, which yields exact matches and
+// nested removes, and otherwise it is read as a mask length followed by the
+// address: four bytes for IPv4, or the first and last two bytes for IPv6,
+// so that they overlap often.
+func fuzzPrefixLists(data []byte) (base, remove []netip.Prefix) {
+	next := func() byte {
+		if len(data) == 0 {
+			return 0
+		}
+		b := data[0]
+		data = data[1:]
+		return b
+	}
+	for len(data) > 0 && len(base)+len(remove) < 32 {
+		op := next()
+		var p netip.Prefix
+		if op>>2%4 == 0 && len(base) > 0 {
+			prev := base[len(base)-1]
+			bits := prev.Bits() + int(next())%(prev.Addr().BitLen()-prev.Bits()+1)
+			p = netip.PrefixFrom(prev.Addr(), bits)
+		} else if op&2 == 0 {
+			bits := int(next()) % 33
+			p = netip.PrefixFrom(netip.AddrFrom4([4]byte{next(), next(), next(), next()}), bits)
+		} else {
+			bits := int(next()) % 129
+			p = netip.PrefixFrom(netip.AddrFrom16([16]byte{0: next(), 1: next(), 14: next(), 15: next()}), bits)
+		}
+		if op&1 == 0 {
+			base = append(base, p)
+		} else {
+			remove = append(remove, p)
+		}
+	}
+	return base, remove
+}
+
+func FuzzSubtractPrefixList(f *testing.F) {
+	f.Add([]byte{4, 8, 10, 0, 0, 0, 1, 0})
+	f.Add([]byte{4, 0, 0, 0, 0, 0, 5, 32, 192, 0, 2, 1, 7, 16, 192, 0, 2, 1})
+	f.Add([]byte{6, 32, 0x20, 0x01, 0, 0, 3, 0})
+	f.Add([]byte{6, 16, 0x20, 0x01, 0, 0, 1, 70, 7, 128, 0x20, 0x01, 0, 1, 7, 1, 0x30, 0, 0, 0, 5, 8, 10, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		base, remove := fuzzPrefixLists(data)
+		result, err := subtractPrefixList(base, remove)
+		if err != nil {
+			t.Fatalf("subtractPrefixList(%s, %s): %v", prefixListToString(base), prefixListToString(remove), err)
+		}
+		if err := verifySubtraction(base, remove, result); err != nil {
+			t.Fatalf("subtractPrefixList(%s, %s) = %s: %v", prefixListToString(base), prefixListToString(remove), prefixListToString(result), err)
+		}
+	})
+}
+
+func BenchmarkSubtractHostAddresses(b *testing.B) {
+	base := parsePrefixes(b, "0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1")
+	remove := make([]netip.Prefix, 0, 512)
+	for i := 0; i < 256; i++ {
+		remove = append(remove, prefixFromAddr(netip.AddrFrom4([4]byte{byte(i), byte(i * 7), 2, 1})))
+		remove = append(remove, prefixFromAddr(netip.AddrFrom16([16]byte{0x20, 0x01, byte(i), 0xb8, 15: 1})))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := subtractPrefixList(base, remove); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSubtractPrefixList(b *testing.B) {
+	base := make([]netip.Prefix, 0, 8192)
+	// Spaced out so that coalescing has nothing to merge.
+	for i := 0; i < 4096; i++ {
+		base = append(base, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 7), byte(i << 1), 0}), 24))
+	}
+	for i := 0; i < 4096; i++ {
+		base = append(base, netip.PrefixFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 7), byte(i << 1)}), 48))
+	}
+	remove := parsePrefixes(b, "10.1.2.3/32", "10.20.0.0/16", "192.0.2.1/32", "2001:db8:100::1/128", "2001:db8:1000::/36", "2001:db9::/32")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := subtractPrefixList(base, remove); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
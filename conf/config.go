@@ -39,18 +39,24 @@ type Config struct {
 }
 
 type Interface struct {
-	PrivateKey Key
-	Addresses  []netip.Prefix
-	ListenPort uint16
-	MTU        uint16
-	DNS        []netip.Addr
-	DNSSearch  []string
-	PreUp      string
-	PostUp     string
-	PreDown    string
-	PostDown   string
-	WstunnelHost string
-	TableOff   bool
+	PrivateKey         Key
+	Addresses          []netip.Prefix
+	ListenPort         uint16
+	MTU                uint16
+	DNS                []netip.Addr
+	DNSSearch          []string
+	PreUp              string
+	PostUp             string
+	PreDown            string
+	PostDown           string
+	WstunnelHost       string
+	WstunnelPort       uint16
+	WstunnelLocalPort  uint16
+	WstunnelExcludeDNS bool
+	// WstunnelDisableExclusion keeps WSTUNNEL_HOST from being excluded from
+	// AllowedIPs, without losing its value.
+	WstunnelDisableExclusion bool
+	TableOff                 bool
 }
 
 type Peer struct {
@@ -60,6 +66,14 @@ type Peer struct {
 	Endpoint            Endpoint
 	PersistentKeepalive uint16
 
+	// WstunnelHost, if set, replaces Interface.WstunnelHost when computing the
+	// exclusions for this peer alone.
+	WstunnelHost string
+
+	// OriginalAllowedIPs holds AllowedIPs as they were before WSTUNNEL_HOST
+	// exclusions were applied, or nil if they never were.
+	OriginalAllowedIPs []netip.Prefix
+
 	RxBytes           Bytes
 	TxBytes           Bytes
 	LastHandshakeTime HandshakeTime
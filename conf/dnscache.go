@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+var resolveCacheTTL = time.Hour
+
+type resolveCacheEntry struct {
+	Addrs   []netip.Addr
+	Expires time.Time
+}
+
+// resolveCache remembers the last addresses each WSTUNNEL_HOST name resolved
+// to, so that a failed lookup can fall back to them. Each tunnel runs in its
+// own service process, so if file is set, the entries are also kept there to
+// outlive a restart of the service.
+type resolveCache struct {
+	sync.Mutex
+	file    string
+	loaded  bool
+	entries map[string]resolveCacheEntry
+}
+
+var wstunnelHostCache resolveCache
+
+// SetWstunnelHostCacheFile sets the file in which the last good addresses of
+// WSTUNNEL_HOST names are kept. If file is empty, they are only kept in memory.
+func SetWstunnelHostCacheFile(file string) {
+	wstunnelHostCache.Lock()
+	defer wstunnelHostCache.Unlock()
+	wstunnelHostCache.file = file
+	wstunnelHostCache.loaded = false
+	wstunnelHostCache.entries = nil
+}
+
+func (cache *resolveCache) resolve(name string, resolver func(string) ([]netip.Addr, error)) ([]netip.Addr, error) {
+	addrs, err := resolver(name)
+	cache.Lock()
+	defer cache.Unlock()
+	cache.load()
+	if err == nil {
+		cache.entries[name] = resolveCacheEntry{append([]netip.Addr(nil), addrs...), time.Now().Add(resolveCacheTTL)}
+		cache.store()
+		return addrs, nil
+	}
+	entry, ok := cache.entries[name]
+	if !ok {
+		return nil, err
+	}
+	if time.Now().After(entry.Expires) {
+		delete(cache.entries, name)
+		cache.store()
+		return nil, err
+	}
+	Logger("Unable to resolve %s, so using last known addresses: %v", name, err)
+	return append([]netip.Addr(nil), entry.Addrs...), nil
+}
+
+func (cache *resolveCache) load() {
+	if cache.loaded {
+		return
+	}
+	cache.loaded = true
+	cache.entries = make(map[string]resolveCacheEntry)
+	if cache.file == "" {
+		return
+	}
+	bytes, err := os.ReadFile(cache.file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			Logger("Unable to read WSTUNNEL_HOST cache: %v", err)
+		}
+		return
+	}
+	if err = json.Unmarshal(bytes, &cache.entries); err != nil {
+		Logger("Unable to parse WSTUNNEL_HOST cache: %v", err)
+		cache.entries = make(map[string]resolveCacheEntry)
+	}
+}
+
+func (cache *resolveCache) store() {
+	if cache.file == "" {
+		return
+	}
+	bytes, err := json.Marshal(cache.entries)
+	if err == nil {
+		err = writeLockedDownFile(cache.file, true, bytes)
+	}
+	if err != nil {
+		Logger("Unable to write WSTUNNEL_HOST cache: %v", err)
+	}
+}
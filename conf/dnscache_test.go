@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveCache(t *testing.T) {
+	defer func(old time.Duration) { resolveCacheTTL = old }(resolveCacheTTL)
+	resolveCacheTTL = time.Hour
+
+	var cache resolveCache
+	addrs := []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+	errLookup := errors.New("lookup failed")
+	good := func(string) ([]netip.Addr, error) { return addrs, nil }
+	bad := func(string) ([]netip.Addr, error) { return nil, errLookup }
+
+	if _, err := cache.resolve("vpn.example.com", bad); err != errLookup {
+		t.Errorf("expected lookup error without a cached entry, got %v", err)
+	}
+	actual, err := cache.resolve("vpn.example.com", good)
+	if noError(t, err) {
+		equal(t, addrs, actual)
+	}
+	actual, err = cache.resolve("vpn.example.com", bad)
+	if noError(t, err) {
+		equal(t, addrs, actual)
+	}
+	if _, err := cache.resolve("other.example.com", bad); err != errLookup {
+		t.Errorf("expected lookup error for uncached name, got %v", err)
+	}
+
+	resolveCacheTTL = -time.Second
+	cache.resolve("vpn.example.com", good)
+	if _, err := cache.resolve("vpn.example.com", bad); err != errLookup {
+		t.Errorf("expected lookup error after expiry, got %v", err)
+	}
+}
+
+func TestResolveCacheFile(t *testing.T) {
+	defer func(old time.Duration) { resolveCacheTTL = old }(resolveCacheTTL)
+	resolveCacheTTL = time.Hour
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	addrs := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	errLookup := errors.New("lookup failed")
+	good := func(string) ([]netip.Addr, error) { return addrs, nil }
+	bad := func(string) ([]netip.Addr, error) { return nil, errLookup }
+
+	first := resolveCache{file: file}
+	if _, err := first.resolve("vpn.example.com", good); !noError(t, err) {
+		return
+	}
+	restarted := resolveCache{file: file}
+	actual, err := restarted.resolve("vpn.example.com", bad)
+	if noError(t, err) {
+		equal(t, addrs, actual)
+	}
+
+	if err := os.WriteFile(file, []byte("not json"), 0o600); !noError(t, err) {
+		return
+	}
+	corrupt := resolveCache{file: file}
+	if _, err := corrupt.resolve("vpn.example.com", bad); err != errLookup {
+		t.Errorf("expected lookup error with a corrupt cache file, got %v", err)
+	}
+}
+
+func TestWstunnelHostCache(t *testing.T) {
+	fakeResolver(t, map[string][]string{"vpn.example.com": {"192.0.2.1"}})
+	newConfig := func() *Config {
+		return &Config{
+			Interface: Interface{WstunnelHost: "vpn.example.com"},
+			Peers:     []Peer{{AllowedIPs: parsePrefixes(t, "0.0.0.0/0")}},
+		}
+	}
+	if _, err := newConfig().ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	resolveHostnameFunc = func(ctx context.Context, name string) ([]netip.Addr, error) {
+		return nil, errFakeNoSuchHost
+	}
+	excludes, err := newConfig().ApplyWstunnelHostExclusions()
+	if noError(t, err) {
+		equal(t, parsePrefixes(t, "192.0.2.1/32"), excludes)
+	}
+}
@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// WstunnelResolverAddr, if not empty, is the address of the DNS server used to
+// resolve WSTUNNEL_HOST hostnames instead of the system resolver, which in
+// split-DNS setups may answer with an internal address that is useless as a
+// bypass. The port defaults to 53. Unlike the system resolver, it does not
+// consult the hosts file; hosts:ALIAS entries do that regardless.
+var WstunnelResolverAddr string
+
+// wstunnelHostResolver returns the function used to resolve WSTUNNEL_HOST
+// hostnames.
+func wstunnelHostResolver() func(context.Context, string) ([]netip.Addr, error) {
+	if endpoint := WstunnelDoHURL; endpoint != "" {
+		return func(ctx context.Context, name string) ([]netip.Addr, error) {
+			ctx, cancel := attemptContext(ctx)
+			defer cancel()
+			return resolveDoH(ctx, endpoint, name)
+		}
+	}
+	if WstunnelResolverAddr == "" {
+		return resolveHostnameFunc
+	}
+	server := WstunnelResolverAddr
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	return func(ctx context.Context, name string) ([]netip.Addr, error) {
+		ctx, cancel := attemptContext(ctx)
+		defer cancel()
+		addrs, err := resolver.LookupNetIP(ctx, "ip", name)
+		if err != nil {
+			return nil, err
+		}
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		return addrs, nil
+	}
+}
+
+type attemptTimeoutKey struct{}
+
+// withAttemptTimeout makes every attempt at resolving a hostname with ctx
+// give up after timeout, without limiting how long retries may go on.
+func withAttemptTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	if timeout <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, attemptTimeoutKey{}, timeout)
+}
+
+// attemptContext returns the context of a single attempt at resolving a
+// hostname with ctx.
+func attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(attemptTimeoutKey{}).(time.Duration); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// resolveRetrying resolves name with once up to maxTries times, waiting delay
+// between tries, for as long as retry reports that the error of a try is
+// temporary. A try that exceeds the attempt timeout of ctx is retried too.
+func resolveRetrying(ctx context.Context, name string, maxTries int, delay time.Duration, once func(string) ([]netip.Addr, error), retry func(error) bool) (resolvedAddrs []netip.Addr, err error) {
+	for i := 0; i < maxTries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, resolveContextError(ctx, name)
+			}
+		}
+		attemptCtx, cancel := attemptContext(ctx)
+		resolvedAddrs, err = resolveContext(attemptCtx, name, once)
+		timedOut := attemptCtx.Err() != nil && ctx.Err() == nil
+		cancel()
+		if err == nil {
+			return
+		}
+		if timedOut {
+			log.Printf("Timed out resolving %s, so sleeping for %v", name, delay)
+			continue
+		}
+		if retry(err) {
+			continue
+		}
+		return
+	}
+	return
+}
+
+func resolveContext(ctx context.Context, name string, resolver func(string) ([]netip.Addr, error)) ([]netip.Addr, error) {
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		addrs, err := resolver(name)
+		done <- result{addrs, err}
+	}()
+	select {
+	case r := <-done:
+		return r.addrs, r.err
+	case <-ctx.Done():
+		return nil, resolveContextError(ctx, name)
+	}
+}
+
+func resolveContextError(ctx context.Context, name string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("lookup of %s timed out: %w", name, ctx.Err())
+	}
+	return fmt.Errorf("lookup of %s canceled: %w", name, ctx.Err())
+}
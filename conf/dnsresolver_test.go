@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveContextTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := resolveContext(ctx, "slow.example.com", func(string) ([]netip.Addr, error) {
+		<-release
+		return nil, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "slow.example.com") || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("unhelpful timeout error: %v", err)
+	}
+
+	addrs, err := resolveContext(context.Background(), "fast.example.com", func(string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+	})
+	if noError(t, err) {
+		equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+	}
+}
+
+func TestResolveRetryingAttemptTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var tries atomic.Int32
+	once := func(string) ([]netip.Addr, error) {
+		if tries.Add(1) < 3 {
+			<-release
+		}
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+	}
+	// Three tries take longer than one attempt timeout, which must not
+	// limit the retries as a whole.
+	ctx := withAttemptTimeout(context.Background(), time.Millisecond*20)
+	addrs, err := resolveRetrying(ctx, "slow.example.com", 10, time.Millisecond*5, once, func(error) bool { return false })
+	if noError(t, err) {
+		equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+	}
+	equal(t, int32(3), tries.Load())
+
+	tries.Store(0)
+	_, err = resolveRetrying(ctx, "slow.example.com", 2, time.Millisecond, once, func(error) bool { return false })
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the last try to time out, got %v", err)
+	}
+	equal(t, int32(2), tries.Load())
+}
+
+// serveDNS answers the A queries sent to the returned address with addr and
+// every other query with no records.
+func serveDNS(t *testing.T, addr netip.Addr) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			reply := append([]byte(nil), buf[:end]...)
+			reply[2], reply[3] = 0x81, 0x80
+			reply[6], reply[7], reply[10], reply[11] = 0, 0, 0, 0
+			if reply[end-4] == 0 && reply[end-3] == 1 {
+				reply[7] = 1
+				a := addr.As4()
+				reply = append(reply, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				reply = append(reply, a[:]...)
+			}
+			conn.WriteTo(reply, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestWstunnelResolverAddr(t *testing.T) {
+	fakeResolver(t, map[string][]string{"wstunnel.example.com": {"10.0.0.1"}})
+	defer func(old string) { WstunnelResolverAddr = old }(WstunnelResolverAddr)
+	excludes, err := parseWstunnelHostExcludes("wstunnel.example.com")
+	if noError(t, err) {
+		equal(t, "10.0.0.1/32", prefixListToString(excludes))
+	}
+	WstunnelResolverAddr = serveDNS(t, netip.MustParseAddr("198.51.100.7"))
+	excludes, err = parseWstunnelHostExcludes("wstunnel.example.com")
+	if noError(t, err) {
+		equal(t, "198.51.100.7/32", prefixListToString(excludes))
+	}
+}
+
+func TestWstunnelDoHURL(t *testing.T) {
+	defer func(old string) { WstunnelDoHURL = old }(WstunnelDoHURL)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/dns-json" {
+			t.Errorf("unexpected Accept header %q", r.Header.Get("Accept"))
+		}
+		switch name, qtype := r.URL.Query().Get("name"), r.URL.Query().Get("type"); {
+		case name != "wstunnel.example.com":
+			w.Write([]byte(`{"Status":3}`))
+		case qtype == "1":
+			w.Write([]byte(`{"Status":0,"Answer":[{"type":5,"data":"edge.example.net."},{"type":1,"data":"198.51.100.7"}]}`))
+		case qtype == "28":
+			w.Write([]byte(`{"Status":0,"Answer":[{"type":28,"data":"2001:db8::7"}]}`))
+		}
+	}))
+	defer server.Close()
+	WstunnelDoHURL = server.URL + "/dns-query"
+	excludes, err := parseWstunnelHostExcludes("wstunnel.example.com")
+	if noError(t, err) {
+		equal(t, "198.51.100.7/32, 2001:db8::7/128", prefixListToString(excludes))
+	}
+	_, err = parseWstunnelHostExcludes("missing.example.com")
+	if err == nil || !strings.Contains(err.Error(), "rcode 3") {
+		t.Errorf("expected NXDOMAIN error, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@
 package conf
 
 import (
+	"context"
 	"log"
 	"net/netip"
 	"time"
@@ -17,33 +18,31 @@ import (
 	"golang.zx2c4.com/wireguard/windows/services"
 )
 
-func resolveHostname(name string) (resolvedIPString string, err error) {
+var resolveHostnameFunc = resolveHostnameRetrying
+
+func resolveHostname(name string) ([]netip.Addr, error) {
+	return resolveHostnameFunc(context.Background(), name)
+}
+
+func resolveHostnameRetrying(ctx context.Context, name string) ([]netip.Addr, error) {
 	maxTries := 10
 	if services.StartedAtBoot() {
 		maxTries *= 3
 	}
-	for i := 0; i < maxTries; i++ {
-		if i > 0 {
-			time.Sleep(time.Second * 4)
-		}
-		resolvedIPString, err = resolveHostnameOnce(name)
-		if err == nil {
-			return
-		}
+	return resolveRetrying(ctx, name, maxTries, time.Second*4, resolveHostnameOnce, func(err error) bool {
 		if err == windows.WSATRY_AGAIN {
 			log.Printf("Temporary DNS error when resolving %s, so sleeping for 4 seconds", name)
-			continue
+			return true
 		}
 		if err == windows.WSAHOST_NOT_FOUND && services.StartedAtBoot() {
 			log.Printf("Host not found when resolving %s at boot time, so sleeping for 4 seconds", name)
-			continue
+			return true
 		}
-		return
-	}
-	return
+		return false
+	})
 }
 
-func resolveHostnameOnce(name string) (resolvedIPString string, err error) {
+func resolveHostnameOnce(name string) (resolvedAddrs []netip.Addr, err error) {
 	hints := windows.AddrinfoW{
 		Family:   windows.AF_UNSPEC,
 		Socktype: windows.SOCK_DGRAM,
@@ -63,22 +62,27 @@ func resolveHostnameOnce(name string) (resolvedIPString string, err error) {
 		return
 	}
 	defer windows.FreeAddrInfoW(result)
-	var v6 netip.Addr
+	var v4, v6 []netip.Addr
+	seen := make(map[netip.Addr]bool)
 	for ; result != nil; result = result.Next {
 		if result.Family != windows.AF_INET && result.Family != windows.AF_INET6 {
 			continue
 		}
 		addr := (*winipcfg.RawSockaddrInet)(unsafe.Pointer(result.Addr)).Addr()
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
 		if addr.Is4() {
-			return addr.String(), nil
-		} else if !v6.IsValid() && addr.Is6() {
-			v6 = addr
+			v4 = append(v4, addr)
+		} else if addr.Is6() {
+			v6 = append(v6, addr)
 		}
 	}
-	if v6.IsValid() {
-		return v6.String(), nil
+	resolvedAddrs = append(v4, v6...)
+	if len(resolvedAddrs) == 0 {
+		err = windows.WSAHOST_NOT_FOUND
 	}
-	err = windows.WSAHOST_NOT_FOUND
 	return
 }
 
@@ -88,11 +92,11 @@ func (config *Config) ResolveEndpoints() error {
 			continue
 		}
 		log.Printf("Resolving endpoint for peer %d: %s", i+1, config.Peers[i].Endpoint.Host)
-		var err error
-		config.Peers[i].Endpoint.Host, err = resolveHostname(config.Peers[i].Endpoint.Host)
+		addrs, err := resolveHostname(config.Peers[i].Endpoint.Host)
 		if err != nil {
 			return err
 		}
+		config.Peers[i].Endpoint.Host = addrs[0].String()
 		log.Printf("Resolved endpoint for peer %d: %s", i+1, config.Peers[i].Endpoint.Host)
 	}
 	return nil
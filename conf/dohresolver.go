@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+)
+
+// WstunnelDoHURL, if not empty, is the URL of a DNS-over-HTTPS server, such as
+// https://cloudflare-dns.com/dns-query, used to resolve WSTUNNEL_HOST hostnames
+// with JSON queries, so that networks tampering with plain DNS cannot redirect
+// the bypass. It takes precedence over WstunnelResolverAddr. The host of the
+// URL itself is resolved by the system resolver, so prefer an IP address.
+var WstunnelDoHURL string
+
+var dohClient = &http.Client{}
+
+type dohResponse struct {
+	Status int
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	}
+}
+
+const (
+	dohTypeA    = 1
+	dohTypeAAAA = 28
+)
+
+// resolveDoH resolves the A and AAAA records of name using the
+// DNS-over-HTTPS server at endpoint.
+func resolveDoH(ctx context.Context, endpoint, name string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var errs []error
+	for _, qtype := range []int{dohTypeA, dohTypeAAAA} {
+		answers, err := queryDoH(ctx, endpoint, name, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addrs = append(addrs, answers...)
+	}
+	if len(addrs) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("DNS-over-HTTPS lookup of %s returned no addresses", name)
+		}
+		return nil, errors.Join(errs...)
+	}
+	return addrs, nil
+}
+
+func queryDoH(ctx context.Context, endpoint, name string, qtype int) ([]netip.Addr, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS-over-HTTPS URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("name", name)
+	query.Set("type", fmt.Sprint(qtype))
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS lookup of %s failed: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS lookup of %s failed: %s", name, resp.Status)
+	}
+	var response dohResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid DNS-over-HTTPS response for %s: %w", name, err)
+	}
+	// Status 3 is NXDOMAIN; any other non-zero rcode is a failure as well.
+	if response.Status != 0 {
+		return nil, fmt.Errorf("DNS-over-HTTPS lookup of %s failed with rcode %d", name, response.Status)
+	}
+	var addrs []netip.Addr
+	for _, answer := range response.Answer {
+		if answer.Type != qtype {
+			continue
+		}
+		addr, err := netip.ParseAddr(answer.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q in DNS-over-HTTPS response for %s", answer.Data, name)
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
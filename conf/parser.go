@@ -118,6 +118,80 @@ func parseTableOff(s string) (bool, error) {
 	return false, err
 }
 
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, &ParseError{l18n.Sprintf("Invalid boolean"), s}
+}
+
+// The WSTUNNEL directives of the [Interface] section, as ToWgQuick writes them.
+const (
+	WstunnelHostDirective             = "WSTUNNEL_HOST"
+	WstunnelLocalPortDirective        = "WSTUNNEL_LOCAL_PORT"
+	WstunnelExcludeDNSDirective       = "WSTUNNEL_EXCLUDE_DNS"
+	WstunnelDisableExclusionDirective = "WSTUNNEL_DISABLE_EXCLUSION"
+)
+
+type wstunnelDirective struct {
+	name  string
+	alias string
+	parse func(iface *Interface, val string) error
+}
+
+var wstunnelDirectives = []wstunnelDirective{
+	{WstunnelHostDirective, "", func(iface *Interface, val string) error {
+		p, err := wstunnelHostPort(val)
+		if err != nil {
+			return &ParseError{l18n.Sprintf("Invalid WSTUNNEL_HOST"), val}
+		}
+		iface.WstunnelHost = val
+		iface.WstunnelPort = p
+		return nil
+	}},
+	{WstunnelLocalPortDirective, "wstunnellocalport", func(iface *Interface, val string) (err error) {
+		iface.WstunnelLocalPort, err = parsePort(val)
+		return
+	}},
+	{WstunnelExcludeDNSDirective, "wstunnelexcludedns", func(iface *Interface, val string) (err error) {
+		iface.WstunnelExcludeDNS, err = parseBool(val)
+		return
+	}},
+	{WstunnelDisableExclusionDirective, "wstunneldisableexclusion", func(iface *Interface, val string) (err error) {
+		iface.WstunnelDisableExclusion, err = parseBool(val)
+		return
+	}},
+}
+
+// IsWstunnelDirective reports whether key, in any case, is a WSTUNNEL
+// directive of the [Interface] section.
+func IsWstunnelDirective(key string) bool {
+	for _, directive := range wstunnelDirectives {
+		if strings.EqualFold(key, directive.name) || (directive.alias != "" && strings.EqualFold(key, directive.alias)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWstunnelDirective parses the [Interface] key, which is in lower case,
+// if it is a WSTUNNEL directive or looks like one, so that a misspelled
+// directive is reported as such.
+func parseWstunnelDirective(iface *Interface, key, val string) (bool, error) {
+	for _, directive := range wstunnelDirectives {
+		if key == strings.ToLower(directive.name) || (directive.alias != "" && key == directive.alias) {
+			return true, directive.parse(iface, val)
+		}
+	}
+	if strings.HasPrefix(key, "wstun") {
+		return true, &ParseError{l18n.Sprintf("Unknown WSTUNNEL directive"), key}
+	}
+	return false, nil
+}
+
 func parseKeyBase64(s string) (*Key, error) {
 	k, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
@@ -196,6 +270,12 @@ func FromWgQuick(s, name string) (*Config, error) {
 			return nil, &ParseError{l18n.Sprintf("Key must have a value"), line}
 		}
 		if parserState == inInterfaceSection {
+			if ok, err := parseWstunnelDirective(&conf.Interface, key, val); ok {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
 			switch key {
 			case "privatekey":
 				k, err := parseKeyBase64(val)
@@ -249,8 +329,6 @@ func FromWgQuick(s, name string) (*Config, error) {
 				conf.Interface.PreDown = val
 			case "postdown":
 				conf.Interface.PostDown = val
-			case "wstunnel_host":
-				conf.Interface.WstunnelHost = val
 			case "table":
 				tableOff, err := parseTableOff(val)
 				if err != nil {
@@ -298,6 +376,11 @@ func FromWgQuick(s, name string) (*Config, error) {
 					return nil, err
 				}
 				peer.Endpoint = *e
+			case "wstunnel_host":
+				if _, err := wstunnelHostPort(val); err != nil {
+					return nil, &ParseError{l18n.Sprintf("Invalid WSTUNNEL_HOST"), val}
+				}
+				peer.WstunnelHost = val
 			default:
 				return nil, &ParseError{l18n.Sprintf("Invalid key for [Peer] section"), key}
 			}
@@ -347,6 +430,12 @@ func FromDriverConfiguration(interfaze *driver.Interface, existingConfig *Config
 			PreDown:   existingConfig.Interface.PreDown,
 			PostDown:  existingConfig.Interface.PostDown,
 			TableOff:  existingConfig.Interface.TableOff,
+
+			WstunnelHost:             existingConfig.Interface.WstunnelHost,
+			WstunnelPort:             existingConfig.Interface.WstunnelPort,
+			WstunnelLocalPort:        existingConfig.Interface.WstunnelLocalPort,
+			WstunnelExcludeDNS:       existingConfig.Interface.WstunnelExcludeDNS,
+			WstunnelDisableExclusion: existingConfig.Interface.WstunnelDisableExclusion,
 		},
 	}
 	if interfaze.Flags&driver.InterfaceHasPrivateKey != 0 {
@@ -365,6 +454,12 @@ func FromDriverConfiguration(interfaze *driver.Interface, existingConfig *Config
 		peer := Peer{}
 		if p.Flags&driver.PeerHasPublicKey != 0 {
 			peer.PublicKey = p.PublicKey
+			for j := range existingConfig.Peers {
+				if existingConfig.Peers[j].PublicKey == peer.PublicKey {
+					peer.WstunnelHost = existingConfig.Peers[j].WstunnelHost
+					break
+				}
+			}
 		}
 		if p.Flags&driver.PeerHasPresharedKey != 0 {
 			peer.PresharedKey = p.PresharedKey
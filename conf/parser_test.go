@@ -6,9 +6,11 @@
 package conf
 
 import (
+	"errors"
 	"net/netip"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -127,3 +129,108 @@ func TestParseEndpoint(t *testing.T) {
 		t.Error("Error was expected")
 	}
 }
+
+func TestWstunnelHostRoundTrip(t *testing.T) {
+	const line = "WSTUNNEL_HOST = wss://vpn.example.com:8443/tunnel, 198.51.100.0/24\n"
+	input := strings.Replace(testInput, "ListenPort = 51820", line+"WSTUNNEL_LOCAL_PORT = 51821\nListenPort = 51820", 1)
+	conf, err := FromWgQuick(input, "test")
+	if !noError(t, err) {
+		return
+	}
+	equal(t, "wss://vpn.example.com:8443/tunnel, 198.51.100.0/24", conf.Interface.WstunnelHost)
+	equal(t, uint16(8443), conf.Interface.WstunnelPort)
+	output := conf.ToWgQuick()
+	if !strings.Contains(output, line) || !strings.Contains(output, "WSTUNNEL_LOCAL_PORT = 51821\n") {
+		t.Errorf("WSTUNNEL_HOST not preserved in:\n%s", output)
+	}
+	reparsed, err := FromWgQuick(output, "test")
+	if noError(t, err) {
+		equal(t, conf.Interface, reparsed.Interface)
+	}
+}
+
+func TestWstunnelExcludeDNSRoundTrip(t *testing.T) {
+	input := strings.Replace(testInput, "ListenPort = 51820", "WSTUNNEL_EXCLUDE_DNS = true\nListenPort = 51820", 1)
+	conf, err := FromWgQuick(input, "test")
+	if !noError(t, err) {
+		return
+	}
+	equal(t, true, conf.Interface.WstunnelExcludeDNS)
+	if output := conf.ToWgQuick(); !strings.Contains(output, "WSTUNNEL_EXCLUDE_DNS = true\n") {
+		t.Errorf("WSTUNNEL_EXCLUDE_DNS not preserved in:\n%s", output)
+	}
+	_, err = FromWgQuick(strings.Replace(input, "= true", "= maybe", 1), "test")
+	if err == nil {
+		t.Error("invalid WSTUNNEL_EXCLUDE_DNS accepted")
+	}
+}
+
+func TestWstunnelDisableExclusionRoundTrip(t *testing.T) {
+	input := strings.Replace(testInput, "ListenPort = 51820", "WSTUNNEL_HOST = 10.192.124.7\nWSTUNNEL_DISABLE_EXCLUSION = true\nListenPort = 51820", 1)
+	conf, err := FromWgQuick(input, "test")
+	if !noError(t, err) {
+		return
+	}
+	equal(t, true, conf.Interface.WstunnelDisableExclusion)
+	if output := conf.ToWgQuick(); !strings.Contains(output, "WSTUNNEL_DISABLE_EXCLUSION = true\n") {
+		t.Errorf("WSTUNNEL_DISABLE_EXCLUSION not preserved in:\n%s", output)
+	}
+}
+
+func TestWstunnelDirectives(t *testing.T) {
+	input := strings.Replace(testInput, "ListenPort = 51820", "wstunnel_host = vpn.example.com:443\nWstunnelLocalPort = 51821\nListenPort = 51820", 1)
+	conf, err := FromWgQuick(input, "test")
+	if noError(t, err) {
+		equal(t, "vpn.example.com:443", conf.Interface.WstunnelHost)
+		equal(t, uint16(51821), conf.Interface.WstunnelLocalPort)
+	}
+	for _, key := range []string{"WSTUNEL_HOST", "WSTUNNEL_HOSTS", "WSTUNNEL_PORT"} {
+		_, err := FromWgQuick(strings.Replace(testInput, "ListenPort = 51820", key+" = vpn.example.com\nListenPort = 51820", 1), "test")
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || !strings.Contains(parseErr.Error(), "Unknown WSTUNNEL directive") {
+			t.Errorf("%s: expected unknown directive error, got %v", key, err)
+		}
+	}
+	equal(t, true, IsWstunnelDirective("wstunnel_exclude_dns"))
+	equal(t, true, IsWstunnelDirective(WstunnelLocalPortDirective))
+	equal(t, false, IsWstunnelDirective("WSTUNNEL_PORT"))
+}
+
+func TestPeerWstunnelHostRoundTrip(t *testing.T) {
+	input := strings.Replace(testInput, "PersistentKeepalive = 100", "PersistentKeepalive = 100\nWSTUNNEL_HOST = wss://b.example.com/ws", 1)
+	conf, err := FromWgQuick(input, "test")
+	if !noError(t, err) {
+		return
+	}
+	equal(t, "", conf.Peers[0].WstunnelHost)
+	equal(t, "wss://b.example.com/ws", conf.Peers[1].WstunnelHost)
+	reparsed, err := FromWgQuick(conf.ToWgQuick(), "test")
+	if noError(t, err) {
+		equal(t, conf.Peers[1].WstunnelHost, reparsed.Peers[1].WstunnelHost)
+	}
+}
+
+func TestToWgQuickWithWstunnel(t *testing.T) {
+	conf, err := FromWgQuick(testInput, "test")
+	if !noError(t, err) {
+		return
+	}
+	conf.Interface.WstunnelHost = "10.192.124.7"
+	if _, err := conf.ApplyWstunnelHostExclusions(); !noError(t, err) {
+		return
+	}
+	text, err := conf.ToWgQuickWithWstunnel()
+	if !noError(t, err) {
+		return
+	}
+	if !strings.Contains(text, "# AllowedIPs before WSTUNNEL_HOST exclusions: 10.192.122.3/32, 10.192.124.1/24\n") {
+		t.Errorf("missing original AllowedIPs comment in:\n%s", text)
+	}
+	parsed, err := FromWgQuick(text, "test")
+	if noError(t, err) {
+		equal(t, "10.192.124.7", parsed.Interface.WstunnelHost)
+		for i := range conf.Peers {
+			equal(t, conf.Peers[i].AllowedIPs, parsed.Peers[i].AllowedIPs)
+		}
+	}
+}
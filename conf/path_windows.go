@@ -136,3 +136,13 @@ func LogFile(createRoot bool) (string, error) {
 	}
 	return filepath.Join(root, "log.bin"), nil
 }
+
+// WstunnelHostCacheFile returns the file in which the tunnel called name keeps
+// the last good addresses of its WSTUNNEL_HOST names.
+func WstunnelHostCacheFile(name string) (string, error) {
+	root, err := RootDirectory(true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, name+".wstunnel-cache.json"), nil
+}
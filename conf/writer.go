@@ -17,6 +17,33 @@ import (
 )
 
 func (conf *Config) ToWgQuick() string {
+	return conf.toWgQuick(false)
+}
+
+// ToWgQuickWithWstunnel is like ToWgQuick, but also records the AllowedIPs each
+// peer had before WSTUNNEL_HOST exclusions in a comment above the adjusted
+// ones, and checks that the result parses back to the same configuration.
+func (conf *Config) ToWgQuickWithWstunnel() (string, error) {
+	text := conf.toWgQuick(true)
+	parsed, err := FromWgQuick(text, conf.Name)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Interface.WstunnelHost != conf.Interface.WstunnelHost || parsed.Interface.WstunnelLocalPort != conf.Interface.WstunnelLocalPort {
+		return "", fmt.Errorf("WSTUNNEL_HOST did not survive serialization")
+	}
+	if len(parsed.Peers) != len(conf.Peers) {
+		return "", fmt.Errorf("serialized config has %d peers instead of %d", len(parsed.Peers), len(conf.Peers))
+	}
+	for i := range conf.Peers {
+		if prefixListToString(parsed.Peers[i].AllowedIPs) != prefixListToString(conf.Peers[i].AllowedIPs) {
+			return "", fmt.Errorf("AllowedIPs of peer %d did not survive serialization", i+1)
+		}
+	}
+	return text, nil
+}
+
+func (conf *Config) toWgQuick(annotateWstunnel bool) string {
 	var output strings.Builder
 	output.WriteString("[Interface]\n")
 
@@ -60,7 +87,16 @@ func (conf *Config) ToWgQuick() string {
 		output.WriteString(fmt.Sprintf("PostDown = %s\n", conf.Interface.PostDown))
 	}
 	if len(conf.Interface.WstunnelHost) > 0 {
-		output.WriteString(fmt.Sprintf("WSTUNNEL_HOST = %s\n", conf.Interface.WstunnelHost))
+		output.WriteString(fmt.Sprintf("%s = %s\n", WstunnelHostDirective, conf.Interface.WstunnelHost))
+	}
+	if conf.Interface.WstunnelLocalPort > 0 {
+		output.WriteString(fmt.Sprintf("%s = %d\n", WstunnelLocalPortDirective, conf.Interface.WstunnelLocalPort))
+	}
+	if conf.Interface.WstunnelExcludeDNS {
+		output.WriteString(WstunnelExcludeDNSDirective + " = true\n")
+	}
+	if conf.Interface.WstunnelDisableExclusion {
+		output.WriteString(WstunnelDisableExclusionDirective + " = true\n")
 	}
 	if conf.Interface.TableOff {
 		output.WriteString("Table = off\n")
@@ -75,6 +111,10 @@ func (conf *Config) ToWgQuick() string {
 			output.WriteString(fmt.Sprintf("PresharedKey = %s\n", peer.PresharedKey.String()))
 		}
 
+		if annotateWstunnel && peer.OriginalAllowedIPs != nil {
+			output.WriteString(fmt.Sprintf("# AllowedIPs before WSTUNNEL_HOST exclusions: %s\n", prefixListToString(peer.OriginalAllowedIPs)))
+		}
+
 		if len(peer.AllowedIPs) > 0 {
 			addrStrings := make([]string, len(peer.AllowedIPs))
 			for i, address := range peer.AllowedIPs {
@@ -87,6 +127,10 @@ func (conf *Config) ToWgQuick() string {
 			output.WriteString(fmt.Sprintf("Endpoint = %s\n", peer.Endpoint.String()))
 		}
 
+		if len(peer.WstunnelHost) > 0 {
+			output.WriteString(fmt.Sprintf("WSTUNNEL_HOST = %s\n", peer.WstunnelHost))
+		}
+
 		if peer.PersistentKeepalive > 0 {
 			output.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", peer.PersistentKeepalive))
 		}
@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// WstunnelHostEntryKind classifies a WSTUNNEL_HOST entry.
+type WstunnelHostEntryKind int
+
+const (
+	// WstunnelHostAddress is a literal IP address, possibly with a port or
+	// in a URL.
+	WstunnelHostAddress WstunnelHostEntryKind = iota
+	// WstunnelHostPrefix is a literal CIDR prefix or START-END range.
+	WstunnelHostPrefix
+	// WstunnelHostName is a hostname, possibly with a port, in a URL, or
+	// with a mask.
+	WstunnelHostName
+	// WstunnelHostToken is any other entry, such as @file, @gateway,
+	// @endpoint, env:NAME, asn:NAME, auto-subnet:HOST, hosts:ALIAS or one
+	// with brace ranges.
+	WstunnelHostToken
+)
+
+func (kind WstunnelHostEntryKind) String() string {
+	switch kind {
+	case WstunnelHostAddress:
+		return "address"
+	case WstunnelHostPrefix:
+		return "prefix"
+	case WstunnelHostName:
+		return "hostname"
+	case WstunnelHostToken:
+		return "token"
+	}
+	return fmt.Sprintf("WstunnelHostEntryKind(%d)", int(kind))
+}
+
+// WstunnelHostSpecEntry is one entry of a WSTUNNEL_HOST value.
+type WstunnelHostSpecEntry struct {
+	// Text is the entry as written, without a leading !.
+	Text string
+	// Keep is set for ! entries, which are kept in the tunnel.
+	Keep bool
+	Kind WstunnelHostEntryKind
+	// Prefixes are known after parsing for literal entries, and for all of
+	// them once resolved.
+	Prefixes []netip.Prefix
+
+	// part is the entry as written.
+	part   string
+	parsed wstunnelHostEntry
+	// err is why the entry failed to parse.
+	err error
+}
+
+// WstunnelHostSpec is a parsed WSTUNNEL_HOST value.
+type WstunnelHostSpec struct {
+	Entries []WstunnelHostSpecEntry
+}
+
+// ParseWstunnelHostSpec parses and classifies the entries of a WSTUNNEL_HOST
+// value without resolving anything, returning the first problem found.
+func ParseWstunnelHostSpec(s string) (WstunnelHostSpec, error) {
+	spec, err := parseWstunnelHostSpec(s)
+	if err != nil {
+		return WstunnelHostSpec{}, err
+	}
+	for i := range spec.Entries {
+		if err := spec.Entries[i].err; err != nil {
+			return WstunnelHostSpec{}, err
+		}
+	}
+	return spec, nil
+}
+
+// parseWstunnelHostSpec is ParseWstunnelHostSpec, but keeps the entries that
+// failed to parse along with their errors, so that the others can still be
+// excluded.
+func parseWstunnelHostSpec(s string) (WstunnelHostSpec, error) {
+	parts, err := splitCommaList(s)
+	if err != nil {
+		return WstunnelHostSpec{}, &WstunnelHostError{Entry: s, Err: err}
+	}
+	spec := WstunnelHostSpec{Entries: make([]WstunnelHostSpecEntry, len(parts))}
+	for i, part := range parts {
+		entry := &spec.Entries[i]
+		entry.Text, entry.part = part, part
+		if strings.HasPrefix(part, "!") {
+			entry.Text, entry.Keep = strings.TrimSpace(part[1:]), true
+		}
+		parsed, err := parseWstunnelHostEntry(entry.Text)
+		if err != nil {
+			entry.err = spec.entryError(i, err)
+			continue
+		}
+		entry.parsed = parsed
+		entry.Kind, entry.Prefixes = parsed.kind()
+	}
+	return spec, nil
+}
+
+// kind returns the kind of entry, and its prefixes if it is a literal.
+func (entry *wstunnelHostEntry) kind() (WstunnelHostEntryKind, []netip.Prefix) {
+	switch entry.form {
+	case formHost:
+		if entry.addr.IsValid() {
+			return WstunnelHostAddress, []netip.Prefix{prefixFromAddr(entry.addr.Unmap())}
+		}
+		return WstunnelHostName, nil
+	case formMaskedHost:
+		return WstunnelHostName, nil
+	case formPrefix:
+		return WstunnelHostPrefix, []netip.Prefix{unmapPrefix(entry.prefixes[0].Masked())}
+	case formRange:
+		return WstunnelHostPrefix, entry.prefixes
+	}
+	return WstunnelHostToken, nil
+}
+
+// entryError says which entry of spec err is about.
+func (spec *WstunnelHostSpec) entryError(i int, err error) error {
+	part := spec.Entries[i].part
+	return fmt.Errorf("WSTUNNEL_HOST entry %d of %d: %w", i+1, len(spec.Entries), classifyWstunnelHostError(part, err))
+}
+
+// Resolve resolves the entries of spec, storing their prefixes. It returns
+// the errors of all entries that failed, which keep only the prefixes that
+// did resolve, such as those of the other lines of an @file entry.
+func (spec *WstunnelHostSpec) Resolve(ctx context.Context) error {
+	errs, err := spec.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// resolve resolves the entries of spec, returning the error of each at its
+// index, or only the error of ctx once it is done. Hostnames are resolved
+// concurrently, at most WstunnelHostResolveConcurrency at a time, and the
+// other entries in order.
+func (spec *WstunnelHostSpec) resolve(ctx context.Context) ([]error, error) {
+	errs := make([]error, len(spec.Entries))
+	resolved := make([]bool, len(spec.Entries))
+	resolveEntry := func(i int) {
+		entry := &spec.Entries[i]
+		entry.Prefixes, errs[i] = nil, entry.err
+		if entry.err != nil {
+			return
+		}
+		prefixes, err := entry.parsed.resolve(ctx)
+		if err != nil {
+			errs[i] = spec.entryError(i, err)
+		}
+		entry.Prefixes = prefixes
+	}
+	var names []int
+	for i := range spec.Entries {
+		if spec.Entries[i].err == nil && spec.Entries[i].Kind == WstunnelHostName {
+			names = append(names, i)
+		}
+	}
+	if WstunnelHostResolveConcurrency > 1 && len(names) > 1 {
+		sem := make(chan struct{}, WstunnelHostResolveConcurrency)
+		var wg sync.WaitGroup
+	start:
+		for _, i := range names {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break start
+			}
+			resolved[i] = true
+			wg.Add(1)
+			go func(i int) {
+				defer func() { <-sem; wg.Done() }()
+				resolveEntry(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+	for i := range spec.Entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !resolved[i] {
+			resolveEntry(i)
+		}
+	}
+	return errs, nil
+}
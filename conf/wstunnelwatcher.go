@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// OnWstunnelHostChanged, if set, is called from the goroutine of a watcher
+// started by StartWstunnelHostWatcher after it re-applied exclusions because
+// the addresses WSTUNNEL_HOST resolves to changed, so that the caller can
+// update its routes.
+var OnWstunnelHostChanged func(config *Config, excludes []netip.Prefix)
+
+// StartWstunnelHostWatcher re-resolves WSTUNNEL_HOST every interval and, when
+// the resulting excludes differ from those last applied, starting with
+// applied as returned by ApplyWstunnelHostExclusions or ApplyExclusions,
+// applies them to config starting from the AllowedIPs stored before the first
+// exclusion. extra is excluded along with them each time, as by
+// ApplyExclusions. Resolution failures keep the current exclusions. Nothing else may modify
+// config until stop has returned, except OnWstunnelHostChanged. stop may be
+// called any number of times, but not from OnWstunnelHostChanged, and waits
+// for the watcher goroutine to exit. Nothing is watched if exclusion is
+// disabled by WSTUNNEL_DISABLE_EXCLUSION.
+func StartWstunnelHostWatcher(config *Config, applied, extra []netip.Prefix, interval time.Duration) (stop func()) {
+	if interval <= 0 || config.Interface.WstunnelDisableExclusion {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := prefixListToString(applied)
+		for {
+			excluder := config.newWstunnelHostExcluder(ctx)
+			excluder.setExtra(extra)
+			excludes, diffs, err := excluder.compute()
+			if ctx.Err() != nil {
+				return
+			}
+			if current := prefixListToString(excludes); err == nil && current != last {
+				Logger("WSTUNNEL_HOST now resolves to %s, so re-applying exclusions", current)
+				excludes, err = config.applyComputedExclusions(excludes, excluder.extra, diffs, nil)
+				if err != nil {
+					Logger("Unable to re-apply WSTUNNEL_HOST exclusions: %v", err)
+				} else {
+					last = prefixListToString(excludes)
+					if OnWstunnelHostChanged != nil {
+						OnWstunnelHostChanged(config, excludes)
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(cancel)
+		<-done
+	}
+}
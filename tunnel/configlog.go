@@ -7,15 +7,59 @@ package tunnel
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 
 	"golang.zx2c4.com/wireguard/windows/conf"
 )
 
-func allowedIPsSummary(conf *conf.Config) string {
-	if conf == nil {
+// configSummary formats the AllowedIPs of a config only when String is
+// called, so that nothing is built when the log output is discarded.
+type configSummary struct {
+	before, after *conf.Config
+}
+
+// allowedIPsSummary lists the AllowedIPs of each peer of conf. It is empty
+// if conf is nil or none of its peers has any.
+func allowedIPsSummary(conf *conf.Config) configSummary {
+	return configSummary{nil, conf}
+}
+
+// allowedIPsSummaryDiff is like allowedIPsSummary for after, but marks the
+// prefixes that were added with "+" and those that were removed with "-",
+// relative to the peer at the same index in before.
+func allowedIPsSummaryDiff(before, after *conf.Config) configSummary {
+	return configSummary{before, after}
+}
+
+func (s configSummary) isEmpty() bool {
+	if s.after == nil {
+		return true
+	}
+	for _, c := range []*conf.Config{s.before, s.after} {
+		if c == nil {
+			continue
+		}
+		for i := range c.Peers {
+			if len(c.Peers[i].AllowedIPs) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s configSummary) String() string {
+	if s.after == nil {
 		return ""
 	}
+	if s.before == nil {
+		return summarizeAllowedIPs(s.after)
+	}
+	return summarizeAllowedIPsDiff(s.before, s.after)
+}
+
+func summarizeAllowedIPs(conf *conf.Config) string {
 	parts := make([]string, 0, len(conf.Peers))
 	for i, peer := range conf.Peers {
 		if len(peer.AllowedIPs) == 0 {
@@ -25,7 +69,52 @@ func allowedIPsSummary(conf *conf.Config) string {
 		for j, ip := range peer.AllowedIPs {
 			ips[j] = ip.String()
 		}
-		parts = append(parts, fmt.Sprintf("peer %d: %s", i+1, strings.Join(ips, ", ")))
+		parts = append(parts, peerSummary(&peer, i, ips))
 	}
 	return strings.Join(parts, "; ")
 }
+
+func summarizeAllowedIPsDiff(before, after *conf.Config) string {
+	parts := make([]string, 0, len(after.Peers))
+	for i, peer := range after.Peers {
+		var original []netip.Prefix
+		if i < len(before.Peers) {
+			original = before.Peers[i].AllowedIPs
+		}
+		if len(peer.AllowedIPs) == 0 && len(original) == 0 {
+			continue
+		}
+		kept := make(map[netip.Prefix]bool, len(original))
+		for _, ip := range original {
+			kept[ip] = true
+		}
+		current := make(map[netip.Prefix]bool, len(peer.AllowedIPs))
+		ips := make([]string, 0, len(peer.AllowedIPs)+len(original))
+		for _, ip := range peer.AllowedIPs {
+			current[ip] = true
+			if kept[ip] {
+				ips = append(ips, ip.String())
+			} else {
+				ips = append(ips, "+"+ip.String())
+			}
+		}
+		for _, ip := range original {
+			if !current[ip] {
+				ips = append(ips, "-"+ip.String())
+			}
+		}
+		parts = append(parts, peerSummary(&peer, i, ips))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func peerSummary(peer *conf.Peer, index int, ips []string) string {
+	return fmt.Sprintf("%s: %s", peerLabel(peer, index), strings.Join(ips, ", "))
+}
+
+func peerLabel(peer *conf.Peer, index int) string {
+	if peer.PublicKey.IsZero() {
+		return fmt.Sprintf("peer %d", index+1)
+	}
+	return fmt.Sprintf("peer %d (%s)", index+1, peer.PublicKey.String()[:8])
+}
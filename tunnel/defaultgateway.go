@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// defaultGateways returns the next hops of the system's default routes, for
+// @gateway WSTUNNEL_HOST entries. On-link routes, like the tunnel's own, have
+// no next hop, and link-local next hops are never routed through the tunnel,
+// so neither is returned.
+func defaultGateways() ([]netip.Addr, error) {
+	var gateways []netip.Addr
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		r, err := winipcfg.GetIPForwardTable2(family)
+		if err != nil {
+			return nil, err
+		}
+		for i := range r {
+			if r[i].DestinationPrefix.PrefixLength != 0 {
+				continue
+			}
+			addr := r[i].NextHop.Addr()
+			if !addr.IsValid() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() {
+				continue
+			}
+			gateways = append(gateways, addr)
+		}
+	}
+	return gateways, nil
+}
+
+// onLinkPrefix returns the most specific on-link route containing addr, for
+// auto-subnet:HOST WSTUNNEL_HOST entries. Default routes are skipped, as an
+// on-link default route says nothing about the subnet of addr.
+func onLinkPrefix(addr netip.Addr) (netip.Prefix, error) {
+	family := winipcfg.AddressFamily(windows.AF_INET6)
+	if addr.Is4() {
+		family = windows.AF_INET
+	}
+	r, err := winipcfg.GetIPForwardTable2(family)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	var best netip.Prefix
+	for i := range r {
+		prefix := r[i].DestinationPrefix.Prefix()
+		if prefix.Bits() <= 0 || !prefix.Contains(addr) {
+			continue
+		}
+		if nextHop := r[i].NextHop.Addr(); nextHop.IsValid() && !nextHop.IsUnspecified() {
+			continue
+		}
+		if !best.IsValid() || prefix.Bits() > best.Bits() {
+			best = prefix
+		}
+	}
+	if !best.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("%s is not on-link", addr)
+	}
+	return best, nil
+}
@@ -115,7 +115,7 @@ func watchInterface() (*interfaceWatcher, error) {
 
 		if state, err := iw.adapter.AdapterState(); err == nil && state == driver.AdapterStateDown {
 			log.Println("Reinitializing adapter configuration")
-			if summary := allowedIPsSummary(iw.conf); summary != "" {
+			if summary := allowedIPsSummary(iw.conf); !summary.isEmpty() {
 				log.Printf("AllowedIPs applied: %s", summary)
 			}
 			err = iw.adapter.SetConfiguration(iw.conf.ToDriverConfiguration())
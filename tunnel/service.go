@@ -7,6 +7,7 @@ package tunnel
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -116,7 +117,8 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	if config.Interface.WstunnelHost != "" {
 		log.Printf("WSTUNNEL_HOST: %s", config.Interface.WstunnelHost)
 	}
-	if summary := allowedIPsSummary(config); summary != "" {
+	config.CheckWstunnelLocalPort()
+	if summary := allowedIPsSummary(config); !summary.isEmpty() {
 		log.Printf("AllowedIPs configured: %s", summary)
 	}
 	config.DeduplicateNetworkEntries()
@@ -156,12 +158,28 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 		serviceError = services.ErrorDNSLookup
 		return
 	}
-	if err := config.ApplyWstunnelHostExclusions(); err != nil {
-		serviceError = services.ErrorDNSLookup
-		return
+	conf.SetGatewayResolver(defaultGateways)
+	conf.SetOnLinkPrefixResolver(onLinkPrefix)
+	if cacheFile, err := conf.WstunnelHostCacheFile(config.Name); err == nil {
+		conf.SetWstunnelHostCacheFile(cacheFile)
+	} else {
+		log.Printf("Unable to locate WSTUNNEL_HOST cache, so keeping it in memory: %v", err)
+	}
+	beforeExclusions := *config
+	beforeExclusions.Peers = append([]conf.Peer(nil), config.Peers...)
+	if excludes, wstunnelErr := config.ApplyWstunnelHostExclusions(); wstunnelErr != nil {
+		if len(excludes) == 0 {
+			err = wstunnelErr
+			serviceError = services.ErrorLoadConfiguration
+			if errors.Is(wstunnelErr, conf.ErrWstunnelHostUnresolvable) {
+				serviceError = services.ErrorDNSLookup
+			}
+			return
+		}
+		log.Printf("Continuing with partial WSTUNNEL_HOST exclusions: %v", wstunnelErr)
 	}
 	config.DeduplicateNetworkEntries()
-	if summary := allowedIPsSummary(config); summary != "" {
+	if summary := allowedIPsSummaryDiff(&beforeExclusions, config); !summary.isEmpty() {
 		log.Printf("AllowedIPs after WSTUNNEL_HOST exclusions: %s", summary)
 	}
 
@@ -215,7 +233,7 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	}
 
 	log.Println("Setting interface configuration")
-	if summary := allowedIPsSummary(config); summary != "" {
+	if summary := allowedIPsSummary(config); !summary.isEmpty() {
 		log.Printf("AllowedIPs applied: %s", summary)
 	}
 	err = adapter.SetConfiguration(config.ToDriverConfiguration())
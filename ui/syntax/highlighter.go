@@ -8,7 +8,11 @@
 
 package syntax
 
-import "unsafe"
+import (
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
 
 type highlight int
 
@@ -65,6 +69,10 @@ func (s stringSpan) at(i int) *byte {
 	return (*byte)(unsafe.Add(unsafe.Pointer(s.s), uintptr(i)))
 }
 
+func (s stringSpan) String() string {
+	return unsafe.String(s.s, s.len)
+}
+
 func (s stringSpan) isSame(c string) bool {
 	if s.len != len(c) {
 		return false
@@ -261,6 +269,10 @@ func (s stringSpan) isValidTable() bool {
 	return s.isSame("off") || s.isSame("auto") || s.isSame("main") || s.isValidUint(false, 0, (1<<32)-1)
 }
 
+func (s stringSpan) isValidBool() bool {
+	return s.isCaselessSame("true") || s.isCaselessSame("false")
+}
+
 func (s stringSpan) isValidPersistentKeepAlive() bool {
 	if s.isSame("off") {
 		return true
@@ -371,12 +383,16 @@ const (
 	fieldPreDown
 	fieldPostDown
 	fieldWstunnelHost
+	fieldWstunnelLocalPort
+	fieldWstunnelExcludeDNS
+	fieldWstunnelDisableExclusion
 	fieldPeerSection
 	fieldPublicKey
 	fieldPresharedKey
 	fieldAllowedIPs
 	fieldEndpoint
 	fieldPersistentKeepalive
+	fieldPeerWstunnelHost
 	fieldInvalid
 )
 
@@ -424,6 +440,12 @@ func (s stringSpan) field() field {
 		return fieldPostDown
 	case s.isCaselessSame("WSTUNNEL_HOST"):
 		return fieldWstunnelHost
+	case s.isCaselessSame("WSTUNNEL_LOCAL_PORT"), s.isCaselessSame("WstunnelLocalPort"):
+		return fieldWstunnelLocalPort
+	case s.isCaselessSame("WSTUNNEL_EXCLUDE_DNS"), s.isCaselessSame("WstunnelExcludeDNS"):
+		return fieldWstunnelExcludeDNS
+	case s.isCaselessSame("WSTUNNEL_DISABLE_EXCLUSION"), s.isCaselessSame("WstunnelDisableExclusion"):
+		return fieldWstunnelDisableExclusion
 	}
 	return fieldInvalid
 }
@@ -447,6 +469,19 @@ func (hsa *highlightSpanArray) append(o *byte, s stringSpan, t highlight) {
 	*hsa = append(*hsa, highlightSpan{t, int((uintptr(unsafe.Pointer(s.s))) - (uintptr(unsafe.Pointer(o)))), s.len})
 }
 
+func (hsa *highlightSpanArray) highlightEndpoint(parent, s stringSpan) {
+	colon := s.len
+	for colon > 0 {
+		colon--
+		if *s.at(colon) == ':' {
+			break
+		}
+	}
+	hsa.append(parent.s, stringSpan{s.s, colon}, highlightHost)
+	hsa.append(parent.s, stringSpan{s.at(colon), 1}, highlightDelimiter)
+	hsa.append(parent.s, stringSpan{s.at(colon + 1), s.len - colon - 1}, highlightPort)
+}
+
 func (hsa *highlightSpanArray) highlightMultivalueValue(parent, s stringSpan, section field) {
 	switch section {
 	case fieldDNS:
@@ -457,13 +492,23 @@ func (hsa *highlightSpanArray) highlightMultivalueValue(parent, s stringSpan, se
 		} else {
 			hsa.append(parent.s, s, highlightError)
 		}
-	case fieldWstunnelHost:
+	case fieldWstunnelHost, fieldPeerWstunnelHost:
+		// The parser decides what is valid, so that the two cannot disagree.
+		if conf.ValidateWstunnelHostSyntax(s.String()) != nil {
+			hsa.append(parent.s, s, highlightError)
+			break
+		}
 		if s.isValidHostname() {
 			hsa.append(parent.s, s, highlightHost)
 			break
 		}
+		if s.isValidEndpoint() {
+			hsa.highlightEndpoint(parent, s)
+			break
+		}
 		if !s.isValidNetwork() {
-			hsa.append(parent.s, s, highlightError)
+			// URLs, @file, !keep, env:NAME, ranges and the other forms.
+			hsa.append(parent.s, s, highlightHost)
 			break
 		}
 		slash := 0
@@ -543,9 +588,11 @@ func (hsa *highlightSpanArray) highlightValue(parent, s stringSpan, section fiel
 		hsa.append(parent.s, s, validateHighlight(s.isValidMTU(), highlightMTU))
 	case fieldTable:
 		hsa.append(parent.s, s, validateHighlight(s.isValidTable(), highlightTable))
+	case fieldWstunnelExcludeDNS, fieldWstunnelDisableExclusion:
+		hsa.append(parent.s, s, validateHighlight(s.isValidBool(), highlightTable))
 	case fieldPreUp, fieldPostUp, fieldPreDown, fieldPostDown:
 		hsa.append(parent.s, s, validateHighlight(s.isValidPrePostUpDown(), highlightCmd))
-	case fieldListenPort:
+	case fieldListenPort, fieldWstunnelLocalPort:
 		hsa.append(parent.s, s, validateHighlight(s.isValidPort(), highlightPort))
 	case fieldPersistentKeepalive:
 		hsa.append(parent.s, s, validateHighlight(s.isValidPersistentKeepAlive(), highlightKeepalive))
@@ -554,17 +601,8 @@ func (hsa *highlightSpanArray) highlightValue(parent, s stringSpan, section fiel
 			hsa.append(parent.s, s, highlightError)
 			break
 		}
-		colon := s.len
-		for colon > 0 {
-			colon--
-			if *s.at(colon) == ':' {
-				break
-			}
-		}
-		hsa.append(parent.s, stringSpan{s.s, colon}, highlightHost)
-		hsa.append(parent.s, stringSpan{s.at(colon), 1}, highlightDelimiter)
-		hsa.append(parent.s, stringSpan{s.at(colon + 1), s.len - colon - 1}, highlightPort)
-	case fieldAddress, fieldDNS, fieldAllowedIPs, fieldWstunnelHost:
+		hsa.highlightEndpoint(parent, s)
+	case fieldAddress, fieldDNS, fieldAllowedIPs, fieldWstunnelHost, fieldPeerWstunnelHost:
 		hsa.highlightMultivalue(parent, s, section)
 	default:
 		hsa.append(parent.s, s, highlightError)
@@ -631,6 +669,9 @@ func highlightConfig(config string) []highlightSpan {
 		} else if *s.at(i) == '=' && state == onKey {
 			currentSpan.len = lenAtLastSpace
 			currentField = currentSpan.field()
+			if currentField == fieldWstunnelHost && currentSection == fieldPeerSection {
+				currentField = fieldPeerWstunnelHost
+			}
 			section := sectionForField(currentField)
 			if section == fieldInvalid || currentField == fieldInvalid || section != currentSection {
 				ret.append(s.s, currentSpan, highlightError)